@@ -16,12 +16,25 @@ var (
 )
 
 var (
-	app        = kingpin.New("tape", "A performance measurement tool for Hyperledger Fabric")
-	run        = app.Command("run", "Run this program").Default()
-	version    = app.Command("version", "Show version information")
-	configFile = run.Flag("config", "Path of config file").Required().Short('c').String()
+	app              = kingpin.New("tape", "A performance measurement tool for Hyperledger Fabric")
+	run              = app.Command("run", "Run this program").Default()
+	version          = app.Command("version", "Show version information")
+	search           = app.Command("search", "Search for the maximum sustainable rate")
+	check            = app.Command("check", "Check the connection to every node and whether the identity is accepted")
+	configCmd        = app.Command("config", "Operate on the config file")
+	validate         = configCmd.Command("validate", "Load the config file and report every problem in it, without connecting to any node")
+	configFile       = run.Flag("config", "Path of config file").Required().Short('c').String()
+	sets             = run.Flag("set", setHelp).Strings()
+	searchConfigFile = search.Flag("config", "Path of config file").Required().Short('c').String()
+	searchSets       = search.Flag("set", setHelp).Strings()
+	checkConfigFile  = check.Flag("config", "Path of config file").Required().Short('c').String()
+	checkSets        = check.Flag("set", setHelp).Strings()
+	validateFile     = validate.Flag("config", "Path of config file").Required().Short('c').String()
+	validateSets     = validate.Flag("set", setHelp).Strings()
 )
 
+const setHelp = "Override a config field, e.g. --set endorsers[0].address=localhost:7051, repeatable"
+
 func setLogLevel(logger *log.Logger) {
 	logger.SetLevel(log.InfoLevel)
 	if value, ok := os.LookupEnv("TAPE_LOGLEVEL"); ok {
@@ -37,10 +50,11 @@ func getLogger() *log.Logger {
 	return logger
 }
 
-func getConfig() *infra.Config {
-	config, err := infra.LoadConfigFromFile(*configFile)
+func getConfig(configFile string, sets ...string) *infra.Config {
+	config, err := infra.LoadConfigFromFile(configFile, sets...)
 	if err != nil {
-		log.Panicf("Fail to load config: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Fail to load config %s: %v\n", configFile, err)
+		os.Exit(1)
 	}
 	return config
 }
@@ -52,8 +66,22 @@ func main() {
 	fullCmd = kingpin.MustParse(app.Parse(os.Args[1:]))
 	switch fullCmd {
 	case run.FullCommand():
-		config := getConfig()
+		config := getConfig(*configFile, *sets...)
 		infra.Process(config, logger)
+	case search.FullCommand():
+		config := getConfig(*searchConfigFile, *searchSets...)
+		infra.Search(config, logger)
+	case check.FullCommand():
+		config := getConfig(*checkConfigFile, *checkSets...)
+		if !infra.Check(config, logger) {
+			os.Exit(1)
+		}
+	case validate.FullCommand():
+		if _, err := infra.ValidateConfigFromFile(*validateFile, *validateSets...); err != nil {
+			fmt.Fprintf(os.Stderr, "Fail to load config %s: %v\n", *validateFile, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Config %s is valid\n", *validateFile)
 	case version.FullCommand():
 		fmt.Printf(infra.GetVersionInfo())
 	default:
@@ -0,0 +1,320 @@
+package infra
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/GwanWingYan/HLF-2.2/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/GwanWingYan/HLF-2.2/protoutil"
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// BatchSizeConfig mirrors 'BatchSize' of the orderer, which is used to infer why a block is cut
+type BatchSizeConfig struct {
+	MaxMessageCount   int `yaml:"maxMessageCount"`   // maximum number of transactions in a block
+	PreferredMaxBytes int `yaml:"preferredMaxBytes"` // preferred maximum bytes of a block
+}
+
+// blockStat is the statistics of one block received in the full block mode
+type blockStat struct {
+	number        uint64
+	txNum         int
+	size          int
+	committedTime int64 // unix nano when the block is received
+	interval      int64 // nanoseconds since the previous block, 0 for the first one
+	cutReason     string
+}
+
+// conflict is an MVCC read conflict confirmed by the read/write sets in the blocks
+type conflict struct {
+	txid   string
+	block  uint64
+	key    string // namespace/key read by the invalid transaction
+	writer string // txid of the last valid transaction writing the key
+}
+
+// BlockRecorder keeps the statistics of full blocks of one channel received from the first committer
+type BlockRecorder struct {
+	channel    string
+	stats      []*blockStat
+	lastWriter map[string]string // txid of the last valid transaction writing each namespace/key
+	conflicts  []*conflict
+	mvccNum    int // number of MVCC read conflicts of the transactions generated in this run
+}
+
+func NewBlockRecorder(channel string) *BlockRecorder {
+	return &BlockRecorder{
+		channel:    channel,
+		lastWriter: make(map[string]string),
+	}
+}
+
+// filterBlock converts a full block to a filtered block, so that the observers handle both in the same way
+func filterBlock(block *common.Block) *peer.FilteredBlock {
+	fb := &peer.FilteredBlock{
+		Number: block.Header.Number,
+	}
+
+	flags := txValidationFlags(block)
+	for i, data := range block.Data.Data {
+		chdr, err := getChannelHeader(data)
+		if err != nil {
+			// Keep the position of the transaction, which private data is indexed by
+			logger.Warnf("Fail to parse transaction %d in block %d: %v", i, block.Header.Number, err)
+			fb.FilteredTransactions = append(fb.FilteredTransactions, &peer.FilteredTransaction{TxValidationCode: flags[i]})
+			continue
+		}
+
+		fb.ChannelId = chdr.ChannelId
+		fb.FilteredTransactions = append(fb.FilteredTransactions, &peer.FilteredTransaction{
+			Txid:             chdr.TxId,
+			Type:             common.HeaderType(chdr.Type),
+			TxValidationCode: flags[i],
+		})
+	}
+
+	return fb
+}
+
+// txValidationFlags returns the validation code of each transaction in the block
+func txValidationFlags(block *common.Block) []peer.TxValidationCode {
+	flags := make([]peer.TxValidationCode, len(block.Data.Data))
+
+	var filter []byte
+	if block.Metadata != nil && len(block.Metadata.Metadata) > int(common.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		filter = block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER]
+	}
+
+	for i := range flags {
+		if i < len(filter) {
+			flags[i] = peer.TxValidationCode(filter[i])
+		} else {
+			flags[i] = peer.TxValidationCode_NOT_VALIDATED
+		}
+	}
+	return flags
+}
+
+func getChannelHeader(data []byte) (*common.ChannelHeader, error) {
+	env, err := protoutil.GetEnvelopeFromBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := protoutil.UnmarshalPayload(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if payload.Header == nil {
+		return nil, errors.New("missing payload header")
+	}
+
+	return protoutil.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+}
+
+// getTxRWSet extracts the read/write set of an endorser transaction
+func getTxRWSet(data []byte) (*rwsetutil.TxRwSet, error) {
+	env, err := protoutil.GetEnvelopeFromBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := protoutil.UnmarshalPayload(env.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := protoutil.UnmarshalTransaction(payload.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.Actions) == 0 {
+		return nil, errors.New("no action in transaction")
+	}
+
+	ccActionPayload, err := protoutil.UnmarshalChaincodeActionPayload(tx.Actions[0].Payload)
+	if err != nil {
+		return nil, err
+	}
+	if ccActionPayload.Action == nil {
+		return nil, errors.New("no endorsed action in transaction")
+	}
+
+	proposalResponsePayload, err := protoutil.UnmarshalProposalResponsePayload(ccActionPayload.Action.ProposalResponsePayload)
+	if err != nil {
+		return nil, err
+	}
+
+	ccAction, err := protoutil.UnmarshalChaincodeAction(proposalResponsePayload.Extension)
+	if err != nil {
+		return nil, err
+	}
+
+	txRWSet := &rwsetutil.TxRwSet{}
+	if err = txRWSet.FromProtoBytes(ccAction.Results); err != nil {
+		return nil, err
+	}
+	return txRWSet, nil
+}
+
+// cutReason infers why the orderer cut the block from the batch size
+func cutReason(txNum int, size int) string {
+	batchSize := config.BatchSize
+	switch {
+	case batchSize.MaxMessageCount > 0 && txNum >= batchSize.MaxMessageCount:
+		return "count"
+	case batchSize.PreferredMaxBytes > 0 && size >= batchSize.PreferredMaxBytes:
+		return "size"
+	case batchSize.MaxMessageCount > 0 || batchSize.PreferredMaxBytes > 0:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// record keeps the statistics of a full block and confirms the MVCC read conflicts in it
+func (br *BlockRecorder) record(block *common.Block, receivedTime int64) {
+	stat := &blockStat{
+		number:        block.Header.Number,
+		txNum:         len(block.Data.Data),
+		size:          proto.Size(block),
+		committedTime: receivedTime,
+	}
+	if len(br.stats) > 0 {
+		stat.interval = receivedTime - br.stats[len(br.stats)-1].committedTime
+	}
+	stat.cutReason = cutReason(stat.txNum, stat.size)
+	br.stats = append(br.stats, stat)
+
+	flags := txValidationFlags(block)
+	for i, data := range block.Data.Data {
+		chdr, err := getChannelHeader(data)
+		if err != nil || common.HeaderType(chdr.Type) != common.HeaderType_ENDORSER_TRANSACTION {
+			continue
+		}
+
+		txRWSet, err := getTxRWSet(data)
+		if err != nil {
+			logger.Warnf("Fail to extract the read/write set of %s: %v", chdr.TxId, err)
+			continue
+		}
+
+		switch flags[i] {
+		case peer.TxValidationCode_MVCC_READ_CONFLICT:
+			if _, ok := txid2id[chdr.TxId]; !ok {
+				continue
+			}
+			br.mvccNum++
+			for _, nsRWSet := range txRWSet.NsRwSets {
+				for _, read := range nsRWSet.KvRwSet.Reads {
+					key := nsRWSet.NameSpace + "/" + read.Key
+					if writer, ok := br.lastWriter[key]; ok {
+						br.conflicts = append(br.conflicts, &conflict{
+							txid:   chdr.TxId,
+							block:  stat.number,
+							key:    key,
+							writer: writer,
+						})
+					}
+				}
+			}
+		case peer.TxValidationCode_VALID:
+			for _, nsRWSet := range txRWSet.NsRwSets {
+				for _, write := range nsRWSet.KvRwSet.Writes {
+					br.lastWriter[nsRWSet.NameSpace+"/"+write.Key] = chdr.TxId
+				}
+			}
+		}
+	}
+}
+
+// reportBlocks writes the summary of blocks of each channel to the report,
+// and the details to the block statistics file and the conflict file
+func reportBlocks(recorders []*BlockRecorder) {
+	if config.DeliverMode == "filtered" {
+		return
+	}
+
+	for _, br := range recorders {
+		br.report()
+	}
+
+	mustWriteBlockStats(recorders)
+	mustWriteConflicts(recorders)
+}
+
+func (br *BlockRecorder) report() {
+	if len(br.stats) == 0 {
+		return
+	}
+
+	var txNum, size int
+	var intervals []int64
+	reasons := make(map[string]int)
+	for _, s := range br.stats {
+		txNum += s.txNum
+		size += s.size
+		if s.interval > 0 {
+			intervals = append(intervals, s.interval)
+		}
+		reasons[s.cutReason]++
+	}
+
+	reportCh <- fmt.Sprintf("Channel %s Blocks: %d, Average Transactions: %.2f, Average Size: %.2fKB, Average Interval: %.2fms",
+		br.channel,
+		len(br.stats),
+		float64(txNum)/float64(len(br.stats)),
+		float64(size)/float64(len(br.stats))/1024,
+		averageLatencyMs(intervals),
+	)
+	reportCh <- fmt.Sprintf("Channel %s Block Cut Reason: count %d, size %d, timeout %d, unknown %d",
+		br.channel, reasons["count"], reasons["size"], reasons["timeout"], reasons["unknown"])
+
+	confirmed := make(map[string]bool)
+	for _, c := range br.conflicts {
+		confirmed[c.txid] = true
+	}
+	reportCh <- fmt.Sprintf("Channel %s MVCC Conflicts: %d, Confirmed by Read/Write Sets: %d", br.channel, br.mvccNum, len(confirmed))
+}
+
+func mustWriteBlockStats(recorders []*BlockRecorder) {
+	file, err := os.Create(config.BlockStatsPath)
+	if err != nil {
+		logger.Fatalf("Fail to create block statistics file %s: %v", config.BlockStatsPath, err)
+	}
+	defer file.Close()
+
+	file.WriteString("channel,block,transactions,bytes,interval(ms),cut,committed\n")
+	for _, br := range recorders {
+		for _, s := range br.stats {
+			file.WriteString(fmt.Sprintf("%s,%d,%d,%d,%.2f,%s,%s\n",
+				br.channel,
+				s.number,
+				s.txNum,
+				s.size,
+				float64(s.interval)/float64(1e6),
+				s.cutReason,
+				time.Unix(0, s.committedTime).Format(time.RFC3339Nano),
+			))
+		}
+	}
+}
+
+func mustWriteConflicts(recorders []*BlockRecorder) {
+	file, err := os.Create(config.ConflictPath)
+	if err != nil {
+		logger.Fatalf("Fail to create conflict file %s: %v", config.ConflictPath, err)
+	}
+	defer file.Close()
+
+	file.WriteString("channel,txid,block,key,writer\n")
+	for _, br := range recorders {
+		for _, c := range br.conflicts {
+			file.WriteString(fmt.Sprintf("%s,%s,%d,%s,%s\n", br.channel, c.txid, c.block, c.key, c.writer))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package infra
+
+import (
+	"testing"
+
+	"github.com/GwanWingYan/HLF-2.2/protoutil"
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCutReason(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+
+	tests := []struct {
+		name      string
+		batchSize BatchSizeConfig
+		txNum     int
+		size      int
+		want      string
+	}{
+		{"batch size unknown", BatchSizeConfig{}, 10, 1000, "unknown"},
+		{"full of transactions", BatchSizeConfig{MaxMessageCount: 10, PreferredMaxBytes: 4096}, 10, 1000, "count"},
+		{"full of bytes", BatchSizeConfig{MaxMessageCount: 10, PreferredMaxBytes: 4096}, 5, 5000, "size"},
+		{"count goes first", BatchSizeConfig{MaxMessageCount: 10, PreferredMaxBytes: 4096}, 10, 5000, "count"},
+		{"neither is full", BatchSizeConfig{MaxMessageCount: 10, PreferredMaxBytes: 4096}, 5, 1000, "timeout"},
+		{"only count is known", BatchSizeConfig{MaxMessageCount: 10}, 5, 1000000, "timeout"},
+		{"only size is known", BatchSizeConfig{PreferredMaxBytes: 4096}, 1000, 4096, "size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{BatchSize: tt.batchSize}
+			if got := cutReason(tt.txNum, tt.size); got != tt.want {
+				t.Errorf("cutReason(%d, %d) = %s, want %s", tt.txNum, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+// envelopeBytes builds a transaction in a block with only the channel header
+func envelopeBytes(channel string, txid string) []byte {
+	return protoutil.MarshalOrPanic(&common.Envelope{
+		Payload: protoutil.MarshalOrPanic(&common.Payload{
+			Header: &common.Header{
+				ChannelHeader: protoutil.MarshalOrPanic(&common.ChannelHeader{
+					Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+					ChannelId: channel,
+					TxId:      txid,
+				}),
+			},
+		}),
+	})
+}
+
+func TestFilterBlock(t *testing.T) {
+	defer func(l *log.Logger) { logger = l }(logger)
+	logger = log.New()
+
+	metadata := func(filter []byte) *common.BlockMetadata {
+		md := make([][]byte, common.BlockMetadataIndex_TRANSACTIONS_FILTER+1)
+		md[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = filter
+		return &common.BlockMetadata{Metadata: md}
+	}
+
+	tests := []struct {
+		name     string
+		data     [][]byte
+		metadata *common.BlockMetadata
+		want     []*peer.FilteredTransaction
+	}{
+		{
+			name:     "empty block",
+			metadata: metadata(nil),
+		},
+		{
+			name:     "valid and invalid transactions",
+			data:     [][]byte{envelopeBytes("mychannel", "tx0"), envelopeBytes("mychannel", "tx1")},
+			metadata: metadata([]byte{byte(peer.TxValidationCode_VALID), byte(peer.TxValidationCode_MVCC_READ_CONFLICT)}),
+			want: []*peer.FilteredTransaction{
+				{Txid: "tx0", Type: common.HeaderType_ENDORSER_TRANSACTION, TxValidationCode: peer.TxValidationCode_VALID},
+				{Txid: "tx1", Type: common.HeaderType_ENDORSER_TRANSACTION, TxValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+			},
+		},
+		{
+			name:     "no transaction filter",
+			data:     [][]byte{envelopeBytes("mychannel", "tx0")},
+			metadata: nil,
+			want: []*peer.FilteredTransaction{
+				{Txid: "tx0", Type: common.HeaderType_ENDORSER_TRANSACTION, TxValidationCode: peer.TxValidationCode_NOT_VALIDATED},
+			},
+		},
+		{
+			name:     "malformed transaction keeps its position",
+			data:     [][]byte{[]byte("not an envelope"), envelopeBytes("mychannel", "tx1")},
+			metadata: metadata([]byte{byte(peer.TxValidationCode_BAD_PAYLOAD), byte(peer.TxValidationCode_VALID)}),
+			want: []*peer.FilteredTransaction{
+				{TxValidationCode: peer.TxValidationCode_BAD_PAYLOAD},
+				{Txid: "tx1", Type: common.HeaderType_ENDORSER_TRANSACTION, TxValidationCode: peer.TxValidationCode_VALID},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := &common.Block{
+				Header:   &common.BlockHeader{Number: 7},
+				Data:     &common.BlockData{Data: tt.data},
+				Metadata: tt.metadata,
+			}
+
+			fb := filterBlock(block)
+			if fb.Number != 7 {
+				t.Errorf("Number = %d, want 7", fb.Number)
+			}
+			if len(tt.want) > 0 && fb.ChannelId != "mychannel" {
+				t.Errorf("ChannelId = %q, want mychannel", fb.ChannelId)
+			}
+			if len(fb.FilteredTransactions) != len(tt.want) {
+				t.Fatalf("%d filtered transactions, want %d", len(fb.FilteredTransactions), len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := fb.FilteredTransactions[i]
+				if got.Txid != want.Txid || got.Type != want.Type || got.TxValidationCode != want.TxValidationCode {
+					t.Errorf("transaction %d = {%s %s %s}, want {%s %s %s}",
+						i, got.Txid, got.Type, got.TxValidationCode, want.Txid, want.Type, want.TxValidationCode)
+				}
+			}
+		})
+	}
+}
@@ -1,81 +1,150 @@
 package infra
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GwanWingYan/fabric-protos-go/common"
 	"github.com/GwanWingYan/fabric-protos-go/orderer"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 )
 
+// BroadcastRetryConfig decides what happens to an envelope which fails to be sent,
+// or is answered with a status other than SUCCESS by the orderer
+type BroadcastRetryConfig struct {
+	Policy      string `yaml:"policy"`      // ['reject', 'resend']
+	MaxAttempts int    `yaml:"maxAttempts"` // 'resend': maximum number of times an envelope is sent, 3 by default
+}
+
+// ordererLeader is the index of the orderer which accepts envelopes last, followed by all
+// broadcasters in the 'leader' policy
+var ordererLeader int32
+
 type Broadcasters struct {
 	broadcasters []*Broadcaster
-	tokenCh      chan struct{}
+	limiter      *RateLimiter
+	failovers    []int32 // number of times broadcasters leave each orderer
 }
 
 func NewBroadcasters(inCh <-chan *Element) *Broadcasters {
+	atomic.StoreInt32(&ordererLeader, 0)
+
 	bs := &Broadcasters{
 		broadcasters: make([]*Broadcaster, config.BroadcasterNum),
-		tokenCh:      make(chan struct{}, int(config.Burst)),
+		limiter:      NewRateLimiter("Broadcast", 1),
+		failovers:    make([]int32, len(config.Orderers)),
 	}
 
 	// The expect throughput for each broadcaster
 	expectTPS := float64(config.Rate) / float64(config.BroadcasterNum)
 
 	for i := 0; i < config.BroadcasterNum; i++ {
-		client, err := CreateBroadcastClient(config.Orderer)
-		if err != nil {
-			logger.Fatalf("Fail to create connection for the No. %d broadcaster: %v", i, err)
-		}
-
-		bs.broadcasters[i] = &Broadcaster{
-			client:           client,
+		b := &Broadcaster{
 			broadcasterIndex: i,
 			expectTPS:        expectTPS,
 			inCh:             inCh,
-			tokenCh:          bs.tokenCh,
+			limiter:          bs.limiter,
+			failovers:        bs.failovers,
+			retryReady:       make(chan struct{}, 1),
 		}
+
+		ordererIndex := firstOrderer(i)
+		stream, err := newBroadcastStream(b, ordererIndex)
+		if err != nil {
+			logger.Fatalf("Fail to create connection for the No. %d broadcaster to %s: %v", i, config.Orderers[ordererIndex].Address, err)
+		}
+		b.stream = stream
+
+		bs.broadcasters[i] = b
 	}
 
 	return bs
 }
 
+// firstOrderer returns the index of the orderer which the broadcaster connects to at the beginning
+func firstOrderer(broadcasterIndex int) int {
+	switch config.OrdererPolicy {
+	case "leader":
+		return int(atomic.LoadInt32(&ordererLeader))
+	case "random":
+		return rand.Intn(len(config.Orderers))
+	default:
+		return broadcasterIndex % len(config.Orderers)
+	}
+}
+
+// nextOrderer returns the index of the orderer to fail over to from the current one.
+// In the 'leader' policy, it is the orderer which accepts envelopes last if another broadcaster
+// has found one, otherwise the next one is tried.
+func nextOrderer(current int) int {
+	n := len(config.Orderers)
+	if config.OrdererPolicy == "leader" {
+		if leader := int(atomic.LoadInt32(&ordererLeader)); leader != current {
+			return leader
+		}
+	}
+	if config.OrdererPolicy == "random" && n > 1 {
+		next := rand.Intn(n - 1)
+		if next >= current {
+			next++
+		}
+		return next
+	}
+	return (current + 1) % n
+}
+
 // StartAsync starts a goroutine for every broadcaster
 func (bs *Broadcasters) StartAsync() {
-	// Use a token bucket to throttle the sending of envelopes
-	go bs.generateTokens()
-
 	// Start multiple goroutines to send envelopes
 	for _, b := range bs.broadcasters {
-		go b.receive()
-		go b.send()
+		goWorker(b.stream.receive)
+		goWorker(b.stream.watch)
+		goWorker(b.send)
 	}
 }
 
-func (bs *Broadcasters) generateTokens() {
-	if config.Rate == 0 {
-		for {
-			bs.tokenCh <- struct{}{}
-		}
-	} else {
-		interval := 1e9 / config.Rate
-		for {
-			bs.tokenCh <- struct{}{}
-			time.Sleep(time.Duration(interval) * time.Nanosecond)
+// report writes the throughput and ack latency of each orderer to the report
+func (bs *Broadcasters) report(duration time.Duration) {
+	latencies := make([][]int64, len(config.Orderers))
+	for _, tk := range timeKeepers.transactions {
+		if tk.OrderedTime != 0 {
+			latencies[tk.ordererIndex] = append(latencies[tk.ordererIndex], tk.OrderedTime-tk.BroadcastTime)
 		}
 	}
+
+	reportCh <- fmt.Sprintf("orderer                        acknowledged    TPS ack-avg(ms) ack-p99(ms) failovers")
+	for i, o := range config.Orderers {
+		reportCh <- fmt.Sprintf("%-30s %12d %6.2f %11.2f %11.2f %9d",
+			o.Address,
+			len(latencies[i]),
+			float64(len(latencies[i]))/duration.Seconds(),
+			averageLatencyMs(latencies[i]),
+			percentileMs(latencies[i], 99),
+			atomic.LoadInt32(&bs.failovers[i]),
+		)
+	}
 }
 
 type Broadcaster struct {
-	client           orderer.AtomicBroadcast_BroadcastClient
+	stream           *broadcastStream // the stream in use, only accessed by send
 	broadcasterIndex int
 	expectTPS        float64
 	inCh             <-chan *Element
-	tokenCh          chan struct{}
+	limiter          *RateLimiter
+	failovers        []int32
+	retries          []*Element    // envelopes to be sent again, unbounded so that the receiving side of streams never blocks
+	retryLock        sync.Mutex    // protects retries
+	retryReady       chan struct{} // signalled when an envelope is added to retries
 }
 
-func (b *Broadcaster) getToken() {
-	<-b.tokenCh
+func (b *Broadcaster) getToken() bool {
+	return b.limiter.Take()
 }
 
 // send collects and send envelopes to the orderer
@@ -83,34 +152,358 @@ func (b *Broadcaster) send() {
 	logger.Infof("Start broadcasting\n")
 
 	for {
+		// Envelopes to be sent again go first, and they do not take tokens again
+		if element, ok := b.nextRetry(); ok {
+			if !b.broadcast(element) {
+				return
+			}
+			continue
+		}
+
 		select {
+		case <-b.retryReady:
 		case element := <-b.inCh:
-			b.getToken()
+			if !b.getToken() || !b.broadcast(element) {
+				return
+			}
+		case <-doneCh:
+			return
+		}
+	}
+}
 
-			timeKeepers.keepBroadcastTime(element.Txid, b.broadcasterIndex)
+// broadcast sends the envelope through the current stream, failing over first if the stream is broken.
+// It returns false if the run ends.
+func (b *Broadcaster) broadcast(element *Element) bool {
+	select {
+	case <-b.stream.failed:
+		if !b.failover(b.stream.err) {
+			return false
+		}
+	default:
+	}
+
+	// Count the envelope as broadcast before pushing it in flight, since its response,
+	// and then a resend or rejection by the receiving side, may arrive before Send returns
+	element.lock.Lock()
+	element.attempts++
+	first := !element.broadcast
+	element.broadcast = true
+	element.sentTime = time.Now().UnixNano()
+	element.lock.Unlock()
+	if first {
+		timeKeepers.keepBroadcastTime(element.Txid, b.broadcasterIndex)
+		Metric.AddBroadcast()
+	}
 
-			err := b.client.Send(element.Envelope)
-			if err != nil {
-				logger.Fatalln(err)
+	stream := b.stream
+	stream.pushInflight(element)
+	err := stream.client.Send(element.Envelope)
+	if err != nil {
+		stream.fail(errors.Wrap(err, "fail to send envelope"))
+		// Unless the receiving side has already drained it from the broken stream,
+		// the envelope is not waiting for any response
+		if stream.removeInflight(element) {
+			if shouldResend(element) {
+				b.resend(element)
+			} else {
+				giveUp(element, "SEND_FAILURE")
 			}
+		}
+		return b.failover(stream.err)
+	}
+
+	return true
+}
+
+// resend queues the envelope to be sent again by the broadcaster without blocking
+func (b *Broadcaster) resend(element *Element) {
+	b.retryLock.Lock()
+	b.retries = append(b.retries, element)
+	b.retryLock.Unlock()
+
+	select {
+	case b.retryReady <- struct{}{}:
+	default:
+	}
+}
+
+// nextRetry removes the oldest envelope to be sent again
+func (b *Broadcaster) nextRetry() (*Element, bool) {
+	b.retryLock.Lock()
+	defer b.retryLock.Unlock()
+
+	if len(b.retries) == 0 {
+		return nil, false
+	}
+	element := b.retries[0]
+	b.retries = b.retries[1:]
+	return element, true
+}
+
+// shouldResend returns true if the envelope can be sent again according to the retry policy
+func shouldResend(element *Element) bool {
+	element.lock.Lock()
+	defer element.lock.Unlock()
+
+	return config.BroadcastRetry.Policy == "resend" && element.attempts < config.BroadcastRetry.MaxAttempts
+}
+
+// giveUp records an envelope which will not be sent again with the reason.
+// Every envelope is counted as broadcast once it is handed to a stream,
+// so only the ones never handed to any stream are dropped.
+func giveUp(element *Element, status string) {
+	element.lock.Lock()
+	broadcast := element.broadcast
+	element.lock.Unlock()
+
+	if broadcast {
+		timeKeepers.keepRejected(element.Txid, status)
+	} else {
+		timeKeepers.keepDropped(element.Txid, "broadcast "+status)
+	}
+	// The transaction never commits, so the virtual client waiting for it moves on
+	completeTx(element.Txid)
+}
+
+// failover recreates the stream on the next orderer, which is the same one if only one is configured,
+// with exponential backoff until success.
+// It returns false if the run ends before connecting.
+func (b *Broadcaster) failover(cause error) bool {
+	from := b.stream.ordererIndex
+	atomic.AddInt32(&b.failovers[from], 1)
+	// The connection is closed once the responses to the envelopes in flight are received
+	b.stream.client.CloseSend()
+
+	backoff := minReconnectBackoff
+	to := from
+	for {
+		to = nextOrderer(to)
+		stream, err := newBroadcastStream(b, to)
+		if err == nil {
+			logger.Warnf("The No. %d broadcaster fails over from %s to %s: %v", b.broadcasterIndex, config.Orderers[from].Address, config.Orderers[to].Address, cause)
+			b.stream = stream
+			goWorker(stream.receive)
+			goWorker(stream.watch)
+			return true
+		}
+
+		logger.Warnf("Fail to connect to %s, retry in %v: %v", config.Orderers[to].Address, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-doneCh:
+			return false
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// broadcastStream is a broadcast stream to one orderer with the transactions in flight on it
+type broadcastStream struct {
+	broadcaster  *Broadcaster
+	client       orderer.AtomicBroadcast_BroadcastClient
+	conn         *grpc.ClientConn // closed when receive returns, after the responses to the envelopes in flight
+	ordererIndex int
+	cancel       context.CancelFunc
+	inflight     []*Element    // envelopes sent but not acknowledged yet, in the order of sending
+	lock         sync.Mutex    // protects inflight
+	failed       chan struct{} // closed when the stream fails
+	err          error         // why the stream fails, set before closing 'failed'
+	once         sync.Once
+	timedOut     int32         // 1 if the stream is cancelled because of the broadcast deadline
+	ended        chan struct{} // closed when receive returns
+}
+
+func newBroadcastStream(b *Broadcaster, ordererIndex int) (*broadcastStream, error) {
+	conn, err := DialConnection(config.Orderers[ordererIndex])
+	if err != nil {
+		return nil, err
+	}
+	trackConn(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := orderer.NewAtomicBroadcastClient(conn).Broadcast(ctx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, errors.Wrap(err, "fail to create broadcast stream")
+	}
+
+	return &broadcastStream{
+		broadcaster:  b,
+		client:       client,
+		conn:         conn,
+		ordererIndex: ordererIndex,
+		cancel:       cancel,
+		failed:       make(chan struct{}),
+		ended:        make(chan struct{}),
+	}, nil
+}
+
+// fail marks the stream as failed, after which the broadcaster fails over to another orderer
+func (s *broadcastStream) fail(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.failed)
+	})
+}
+
+// pushInflight appends a transaction about to be sent to the orderer
+func (s *broadcastStream) pushInflight(element *Element) {
+	s.lock.Lock()
+	s.inflight = append(s.inflight, element)
+	s.lock.Unlock()
+}
+
+// removeInflight removes the transaction which fails to be sent.
+// It returns false if the transaction is no longer in flight.
+func (s *broadcastStream) removeInflight(element *Element) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := len(s.inflight) - 1; i >= 0; i-- {
+		if s.inflight[i] == element {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// popInflight removes the oldest transaction in flight, which the next response acknowledges
+// since the orderer responds in order on each stream
+func (s *broadcastStream) popInflight() (*Element, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.inflight) == 0 {
+		return nil, false
+	}
+	element := s.inflight[0]
+	s.inflight = s.inflight[1:]
+	return element, true
+}
+
+// oldestSentTime returns when the oldest transaction in flight is sent, or 0 if none is in flight
+func (s *broadcastStream) oldestSentTime() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.inflight) == 0 {
+		return 0
+	}
+	oldest := s.inflight[0]
+	oldest.lock.Lock()
+	defer oldest.lock.Unlock()
+	return oldest.sentTime
+}
+
+// watch cancels the stream if the oldest transaction in flight is not acknowledged before the
+// broadcast deadline, so that a hung orderer does not hold the broadcaster and the transactions forever
+func (s *broadcastStream) watch() {
+	if config.Timeout.Broadcast == 0 {
+		return
+	}
+	timeout := time.Duration(config.Timeout.Broadcast) * time.Millisecond
+
+	ticker := time.NewTicker(completionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sentTime := s.oldestSentTime()
+			if sentTime == 0 || time.Since(time.Unix(0, sentTime)) < timeout {
+				continue
+			}
+
+			logger.Warnf("No broadcast response from %s in %v", config.Orderers[s.ordererIndex].Address, timeout)
+			atomic.StoreInt32(&s.timedOut, 1)
+			s.fail(errors.Errorf("no broadcast response in %v", timeout))
+			s.cancel()
+			return
+		case <-s.ended:
+			return
 		case <-doneCh:
 			return
 		}
 	}
 }
 
-func (b *Broadcaster) receive() {
+// drainInflight removes all transactions in flight, whose responses will never arrive
+func (s *broadcastStream) drainInflight() []*Element {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	inflight := s.inflight
+	s.inflight = nil
+	return inflight
+}
+
+// receive matches responses to transactions in flight until the stream ends
+func (s *broadcastStream) receive() {
+	defer close(s.ended)
+	defer s.conn.Close()
+	defer s.cancel()
+
 	for {
-		res, err := b.client.Recv()
+		res, err := s.client.Recv()
 		if err != nil {
-			if err != io.EOF {
+			select {
+			case <-doneCh:
+				return
+			default:
+			}
+
+			timedOut := atomic.LoadInt32(&s.timedOut) == 1
+			if err != io.EOF && !timedOut {
 				logger.Errorf("Recieve broadcast error: %+v, status: %+v\n", err, res)
 			}
+			s.fail(errors.Wrap(err, "fail to receive broadcast response"))
+
+			// Whether the orderer has got these transactions is unknown, so they are
+			// sent again if the policy allows, otherwise they are rejected
+			for _, element := range s.drainInflight() {
+				if timedOut {
+					Metric.AddBroadcastTimeout()
+				}
+				switch {
+				case shouldResend(element):
+					s.broadcaster.resend(element)
+				case timedOut:
+					giveUp(element, "TIMEOUT")
+				default:
+					giveUp(element, "STREAM_BROKEN")
+				}
+			}
 			return
 		}
 
-		if res.Status != common.Status_SUCCESS {
-			logger.Fatalf("Receive error status %s", res.Status)
+		element, ok := s.popInflight()
+		if !ok {
+			logger.Warnf("Receive a broadcast response without any transaction in flight")
+			continue
+		}
+
+		if res.Status == common.Status_SUCCESS {
+			timeKeepers.keepOrderedTime(element.Txid, s.ordererIndex)
+			atomic.StoreInt32(&ordererLeader, int32(s.ordererIndex))
+			continue
+		}
+
+		logger.Warnf("Receive status %s for %s from %s: %s", res.Status, element.Txid, config.Orderers[s.ordererIndex].Address, res.Info)
+		if shouldResend(element) {
+			s.broadcaster.resend(element)
+		} else {
+			giveUp(element, res.Status.String())
+		}
+
+		if res.Status == common.Status_SERVICE_UNAVAILABLE {
+			// The orderer may have lost its leader, so try another one.
+			// Keep receiving the responses to the transactions already sent.
+			s.fail(errors.Errorf("receive status %s", res.Status))
 		}
 	}
 }
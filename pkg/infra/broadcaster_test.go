@@ -0,0 +1,487 @@
+package infra
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/GwanWingYan/fabric-protos-go/orderer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakeBroadcastClient is an orderer which hands every envelope sent to 'sent',
+// and responds with whatever is put into 'responses'. A nil response breaks the stream.
+type fakeBroadcastClient struct {
+	orderer.AtomicBroadcast_BroadcastClient
+	sent      chan *common.Envelope
+	responses chan *orderer.BroadcastResponse
+}
+
+func newFakeBroadcastClient() *fakeBroadcastClient {
+	return &fakeBroadcastClient{
+		sent:      make(chan *common.Envelope, 10),
+		responses: make(chan *orderer.BroadcastResponse, 10),
+	}
+}
+
+func (c *fakeBroadcastClient) Send(envelope *common.Envelope) error {
+	c.sent <- envelope
+	return nil
+}
+
+func (c *fakeBroadcastClient) Recv() (*orderer.BroadcastResponse, error) {
+	res := <-c.responses
+	if res == nil {
+		return nil, io.EOF
+	}
+	return res, nil
+}
+
+// idleConn returns a connection which is never used, to be closed by a stream under test
+func idleConn(t *testing.T) *grpc.ClientConn {
+	conn, err := grpc.Dial("127.0.0.1:0", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Fail to create connection: %v", err)
+	}
+	return conn
+}
+
+func TestBroadcastStreamInflight(t *testing.T) {
+	defer func(c *Config, l *log.Logger, m map[string]int, tks TimeKeepers, lc chan string, s *Schedule, d chan struct{}, mi *MetricInstance) {
+		config, logger, txid2id, timeKeepers, logCh, schedule, doneCh, Metric = c, l, m, tks, lc, s, d, mi
+	}(config, logger, txid2id, timeKeepers, logCh, schedule, doneCh, Metric)
+
+	logger = log.New()
+	config = &Config{TxNum: 3, Orderers: make([]Node, 1), BroadcastRetry: BroadcastRetryConfig{Policy: "reject", MaxAttempts: 3}}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1, "tx2": 2}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	schedule = &Schedule{unlimited: true}
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+	Metric = NewMetricInstance()
+
+	inCh := make(chan *Element, 3)
+	client := newFakeBroadcastClient()
+	b := &Broadcaster{inCh: inCh, limiter: &RateLimiter{}}
+	b.stream = &broadcastStream{broadcaster: b, client: client, conn: idleConn(t), cancel: func() {}, failed: make(chan struct{}), ended: make(chan struct{})}
+	go b.send()
+
+	for _, txid := range []string{"tx0", "tx1", "tx2"} {
+		inCh <- &Element{Txid: txid, Envelope: &common.Envelope{}}
+		select {
+		case <-client.sent:
+		case <-time.After(time.Second):
+			t.Fatalf("%s is not sent", txid)
+		}
+	}
+
+	// The orderer acknowledges the first two transactions in order, with a delay between them
+	client.responses <- &orderer.BroadcastResponse{Status: common.Status_SUCCESS}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.responses <- &orderer.BroadcastResponse{Status: common.Status_SUCCESS}
+		client.responses <- nil
+	}()
+	b.stream.receive()
+
+	tks := timeKeepers.transactions
+	if tks[0].OrderedTime == 0 || tks[1].OrderedTime == 0 {
+		t.Fatalf("tx0 and tx1 are not ordered after being acknowledged")
+	}
+	if tks[1].OrderedTime-tks[0].OrderedTime < int64(10*time.Millisecond) {
+		t.Errorf("tx1 is ordered %v after tx0, want the second response to acknowledge it", time.Duration(tks[1].OrderedTime-tks[0].OrderedTime))
+	}
+	if tks[2].OrderedTime != 0 {
+		t.Errorf("tx2 is ordered without a response")
+	}
+	// The response to tx2 never arrives after the stream breaks
+	if len(b.stream.inflight) != 0 {
+		t.Errorf("%d transactions are still in flight after the stream breaks, want none", len(b.stream.inflight))
+	}
+	select {
+	case <-b.stream.failed:
+	default:
+		t.Errorf("the stream is not failed after it breaks")
+	}
+	if n := atomic.LoadInt32(&Metric.Broadcast); n != 3 {
+		t.Errorf("Broadcast = %d, want 3", n)
+	}
+}
+
+func TestFirstOrderer(t *testing.T) {
+	defer func(c *Config, leader int32) {
+		config, ordererLeader = c, leader
+	}(config, ordererLeader)
+
+	tests := []struct {
+		name        string
+		policy      string
+		ordererNum  int
+		leader      int32
+		broadcaster int
+		want        int
+	}{
+		{"round robin", "roundRobin", 3, 0, 1, 1},
+		{"round robin wraps", "roundRobin", 3, 0, 4, 1},
+		{"single orderer", "roundRobin", 1, 0, 5, 0},
+		{"leader", "leader", 3, 2, 0, 2},
+		{"leader for every broadcaster", "leader", 3, 2, 4, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{OrdererPolicy: tt.policy, Orderers: make([]Node, tt.ordererNum)}
+			ordererLeader = tt.leader
+			if got := firstOrderer(tt.broadcaster); got != tt.want {
+				t.Errorf("firstOrderer(%d) = %d, want %d", tt.broadcaster, got, tt.want)
+			}
+		})
+	}
+
+	config = &Config{OrdererPolicy: "random", Orderers: make([]Node, 3)}
+	for i := 0; i < 100; i++ {
+		if got := firstOrderer(i); got < 0 || got >= 3 {
+			t.Fatalf("firstOrderer(%d) = %d in the random policy, out of range [0, 3)", i, got)
+		}
+	}
+}
+
+func TestNextOrderer(t *testing.T) {
+	defer func(c *Config, leader int32) {
+		config, ordererLeader = c, leader
+	}(config, ordererLeader)
+
+	tests := []struct {
+		name       string
+		policy     string
+		ordererNum int
+		leader     int32
+		current    int
+		want       int
+	}{
+		{"round robin", "roundRobin", 3, 0, 0, 1},
+		{"round robin wraps", "roundRobin", 3, 0, 2, 0},
+		{"single orderer retries itself", "roundRobin", 1, 0, 0, 0},
+		{"leader found by another broadcaster", "leader", 3, 2, 0, 2},
+		{"leader fails", "leader", 3, 1, 1, 2},
+		{"leader fails and wraps", "leader", 3, 2, 2, 0},
+		{"random with a single orderer", "random", 1, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{OrdererPolicy: tt.policy, Orderers: make([]Node, tt.ordererNum)}
+			ordererLeader = tt.leader
+			if got := nextOrderer(tt.current); got != tt.want {
+				t.Errorf("nextOrderer(%d) = %d, want %d", tt.current, got, tt.want)
+			}
+		})
+	}
+
+	config = &Config{OrdererPolicy: "random", Orderers: make([]Node, 3)}
+	for i := 0; i < 100; i++ {
+		current := i % 3
+		if got := nextOrderer(current); got == current || got < 0 || got >= 3 {
+			t.Fatalf("nextOrderer(%d) = %d in the random policy, want another orderer in [0, 3)", current, got)
+		}
+	}
+}
+
+func TestShouldResend(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+
+	tests := []struct {
+		name     string
+		policy   string
+		attempts int
+		want     bool
+	}{
+		{"reject", "reject", 1, false},
+		{"resend", "resend", 1, true},
+		{"resend until the last attempt", "resend", 2, true},
+		{"no attempt left", "resend", 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{BroadcastRetry: BroadcastRetryConfig{Policy: tt.policy, MaxAttempts: 3}}
+			if got := shouldResend(&Element{attempts: tt.attempts}); got != tt.want {
+				t.Errorf("shouldResend() after %d attempts = %v, want %v", tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	defer func(c *Config, m map[string]int, tks TimeKeepers, lc chan string, mi *MetricInstance, cs []chan struct{}, cd []int32) {
+		config, txid2id, timeKeepers, logCh, Metric, completions, completed = c, m, tks, lc, mi, cs, cd
+	}(config, txid2id, timeKeepers, logCh, Metric, completions, completed)
+
+	tests := []struct {
+		name        string
+		broadcast   bool
+		wantDropped bool
+	}{
+		{"handed to a stream", true, false},
+		{"never handed to a stream", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{TxNum: 1, ClosedLoop: ClosedLoopConfig{Clients: 1, WaitFor: "commit"}}
+			txid2id = map[string]int{"tx0": 0}
+			initTimeKeepers()
+			initCompletions()
+			logCh = make(chan string, 10)
+			Metric = NewMetricInstance()
+
+			giveUp(&Element{Txid: "tx0", broadcast: tt.broadcast}, "SEND_FAILURE")
+
+			tk := timeKeepers.transactions[0]
+			if dropped := tk.dropped != 0; dropped != tt.wantDropped {
+				t.Errorf("dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+			if rejected := tk.rejected != 0; rejected == tt.wantDropped {
+				t.Errorf("rejected = %v, want %v", rejected, !tt.wantDropped)
+			}
+			select {
+			case <-completions[0]:
+			default:
+				t.Errorf("the virtual client still waits for tx0 which is given up")
+			}
+		})
+	}
+}
+
+func TestBroadcastStreamStatuses(t *testing.T) {
+	defer func(c *Config, l *log.Logger, m map[string]int, tks TimeKeepers, lc chan string, d chan struct{}, mi *MetricInstance) {
+		config, logger, txid2id, timeKeepers, logCh, doneCh, Metric = c, l, m, tks, lc, d, mi
+	}(config, logger, txid2id, timeKeepers, logCh, doneCh, Metric)
+
+	logger = log.New()
+	config = &Config{TxNum: 3, Orderers: make([]Node, 1), BroadcastRetry: BroadcastRetryConfig{Policy: "resend", MaxAttempts: 2}}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1, "tx2": 2}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+	Metric = NewMetricInstance()
+
+	client := newFakeBroadcastClient()
+	b := &Broadcaster{retryReady: make(chan struct{}, 1)}
+	s := &broadcastStream{broadcaster: b, client: client, conn: idleConn(t), cancel: func() {}, failed: make(chan struct{}), ended: make(chan struct{})}
+	b.stream = s
+
+	elements := []*Element{
+		{Txid: "tx0", attempts: 1, broadcast: true},
+		// Has no attempt left, so it is rejected
+		{Txid: "tx1", attempts: 2, broadcast: true},
+		{Txid: "tx2", attempts: 1, broadcast: true},
+	}
+	for _, e := range elements {
+		s.pushInflight(e)
+	}
+
+	client.responses <- &orderer.BroadcastResponse{Status: common.Status_SUCCESS}
+	client.responses <- &orderer.BroadcastResponse{Status: common.Status_BAD_REQUEST}
+	client.responses <- &orderer.BroadcastResponse{Status: common.Status_SERVICE_UNAVAILABLE}
+	client.responses <- nil
+	s.receive()
+
+	if timeKeepers.transactions[0].OrderedTime == 0 {
+		t.Errorf("tx0 is not ordered")
+	}
+	if Metric.Rejected != 1 || timeKeepers.transactions[1].rejected != 1 {
+		t.Errorf("tx1 is not rejected, %d rejected in total", Metric.Rejected)
+	}
+	if e, ok := b.nextRetry(); !ok {
+		t.Errorf("tx2 is not to be sent again after the orderer is unavailable")
+	} else if e.Txid != "tx2" {
+		t.Errorf("%s is to be sent again, want tx2", e.Txid)
+	}
+	select {
+	case <-s.failed:
+	default:
+		t.Errorf("the stream is not failed after the orderer is unavailable")
+	}
+}
+
+// waitFor polls 'cond' until it holds, and fails the test if it does not in 5 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// fakeOrdererServer records the txid carried by the payload of each envelope.
+// It acknowledges every envelope, unless it breaks the stream after 'breakAfter' envelopes
+// or it is 'silent'.
+type fakeOrdererServer struct {
+	orderer.UnimplementedAtomicBroadcastServer
+	breakAfter int
+	silent     bool
+	lock       sync.Mutex
+	received   []string
+}
+
+func (s *fakeOrdererServer) Broadcast(stream orderer.AtomicBroadcast_BroadcastServer) error {
+	for {
+		envelope, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		s.received = append(s.received, string(envelope.Payload))
+		n := len(s.received)
+		s.lock.Unlock()
+
+		if s.breakAfter > 0 {
+			if n == s.breakAfter {
+				return errors.New("orderer crashes")
+			}
+			continue
+		}
+		if s.silent {
+			continue
+		}
+		if err = stream.Send(&orderer.BroadcastResponse{Status: common.Status_SUCCESS}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *fakeOrdererServer) txids() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+// serveOrderer starts the orderer on a local port and returns its node with the function to stop it
+func serveOrderer(t *testing.T, s *fakeOrdererServer) (Node, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	orderer.RegisterAtomicBroadcastServer(server, s)
+	go server.Serve(lis)
+	return Node{Address: lis.Addr().String()}, server.Stop
+}
+
+func TestBroadcasterFailover(t *testing.T) {
+	defer func(c *Config, l *log.Logger, m map[string]int, tks TimeKeepers, lc chan string, s *Schedule, d chan struct{}, mi *MetricInstance, rls []*RateLimiter) {
+		config, logger, txid2id, timeKeepers, logCh, schedule, doneCh, Metric, rateLimiters = c, l, m, tks, lc, s, d, mi, rls
+	}(config, logger, txid2id, timeKeepers, logCh, schedule, doneCh, Metric, rateLimiters)
+
+	// The first orderer crashes after receiving two envelopes, none of which is acknowledged
+	crashing, healthy := &fakeOrdererServer{breakAfter: 2}, &fakeOrdererServer{}
+	node0, stop0 := serveOrderer(t, crashing)
+	defer stop0()
+	node1, stop1 := serveOrderer(t, healthy)
+	defer stop1()
+
+	logger = log.New()
+	config = &Config{
+		TxNum:          3,
+		Burst:          10,
+		BroadcasterNum: 1,
+		Orderers:       []Node{node0, node1},
+		OrdererPolicy:  "roundRobin",
+		BroadcastRetry: BroadcastRetryConfig{Policy: "resend", MaxAttempts: 3},
+	}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1, "tx2": 2}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	schedule = &Schedule{unlimited: true}
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+	Metric = NewMetricInstance()
+
+	inCh := make(chan *Element)
+	element := func(txid string) *Element {
+		return &Element{Txid: txid, Envelope: &common.Envelope{Payload: []byte(txid)}}
+	}
+	bs := NewBroadcasters(inCh)
+	bs.StartAsync()
+	inCh <- element("tx0")
+	inCh <- element("tx1")
+
+	// Wait until both envelopes are sent again to the second orderer, before sending another one
+	waitFor(t, "failover", func() bool { return len(healthy.txids()) == 2 })
+	inCh <- element("tx2")
+	waitFor(t, "tx2", func() bool { return len(healthy.txids()) == 3 })
+
+	if got := crashing.txids(); len(got) != 2 || got[0] != "tx0" || got[1] != "tx1" {
+		t.Errorf("the first orderer receives %v, want [tx0 tx1]", got)
+	}
+	if got := healthy.txids(); got[0] != "tx0" || got[1] != "tx1" || got[2] != "tx2" {
+		t.Errorf("the second orderer receives %v, want the envelopes in flight sent again in order before tx2", got)
+	}
+	if n := atomic.LoadInt32(&bs.failovers[0]); n != 1 {
+		t.Errorf("%d failovers from the first orderer, want 1", n)
+	}
+	waitFor(t, "acknowledgement", func() bool {
+		return atomic.LoadInt64(&timeKeepers.transactions[2].OrderedTime) != 0
+	})
+	if n := atomic.LoadInt32(&Metric.Broadcast); n != 3 {
+		t.Errorf("Broadcast = %d, want 3 without counting envelopes sent again", n)
+	}
+}
+
+func TestBroadcastDeadline(t *testing.T) {
+	defer func(c *Config, l *log.Logger, m map[string]int, tks TimeKeepers, lc chan string, s *Schedule, d chan struct{}, mi *MetricInstance, rls []*RateLimiter) {
+		config, logger, txid2id, timeKeepers, logCh, schedule, doneCh, Metric, rateLimiters = c, l, m, tks, lc, s, d, mi, rls
+	}(config, logger, txid2id, timeKeepers, logCh, schedule, doneCh, Metric, rateLimiters)
+
+	// The orderer hangs without acknowledging anything
+	hung := &fakeOrdererServer{silent: true}
+	node, stop := serveOrderer(t, hung)
+	defer stop()
+
+	logger = log.New()
+	config = &Config{
+		TxNum:          1,
+		Burst:          10,
+		BroadcasterNum: 1,
+		Orderers:       []Node{node},
+		BroadcastRetry: BroadcastRetryConfig{Policy: "reject", MaxAttempts: 3},
+		Timeout:        TimeoutConfig{Broadcast: 200},
+	}
+	txid2id = map[string]int{"tx0": 0}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	schedule = &Schedule{unlimited: true}
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+	Metric = NewMetricInstance()
+
+	inCh := make(chan *Element)
+	bs := NewBroadcasters(inCh)
+	bs.StartAsync()
+	start := time.Now()
+	inCh <- &Element{Txid: "tx0", Envelope: &common.Envelope{Payload: []byte("tx0")}}
+
+	waitFor(t, "rejection", func() bool { return atomic.LoadInt32(&Metric.Rejected) == 1 })
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("tx0 is rejected after %v, before the deadline", elapsed)
+	}
+	if n := atomic.LoadInt32(&Metric.BroadcastTimeouts); n != 1 {
+		t.Errorf("BroadcastTimeouts = %d, want 1", n)
+	}
+	select {
+	case <-bs.broadcasters[0].stream.failed:
+	default:
+		t.Errorf("the stream to the hung orderer is not failed")
+	}
+}
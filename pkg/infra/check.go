@@ -0,0 +1,226 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/GwanWingYan/fabric-protos-go/orderer"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// checkTimeout is the deadline of each probe of 'tape check'
+	checkTimeout = 10 * time.Second
+)
+
+// checkResult is the outcome of checking one node on one channel
+type checkResult struct {
+	role     string
+	address  string
+	channel  string
+	dial     string // time to establish the gRPC connection, or "FAIL"
+	tls      string // "ok", "FAIL" or "-" without TLS
+	probe    string // "ok" or "FAIL" for the test proposal or Deliver seek
+	identity string // whether the node accepts the client identity, "-" if unknown
+	detail   string // the first error, if any
+}
+
+func (r *checkResult) passed() bool {
+	return r.detail == ""
+}
+
+// Check dials every node, completes the TLS handshake, sends a test proposal to each endorser
+// and a Deliver seek to each committer and orderer, and prints the results as a table.
+// It returns false if any check fails.
+func Check(c *Config, l *log.Logger) bool {
+	config = c
+	logger = l
+
+	roles := []struct {
+		role  string
+		nodes []Node
+		probe func(node Node, channel string) (bool, error)
+	}{
+		{"endorser", config.Endorsers, probeEndorser},
+		{"committer", config.Committers, probePeerDeliver},
+		{"orderer", config.Orderers, probeOrdererDeliver},
+	}
+
+	var results []*checkResult
+	for _, channel := range config.Channels {
+		for _, r := range roles {
+			for _, node := range r.nodes {
+				// The committer and orderer may be left out in query mode
+				if node.Address == "" {
+					continue
+				}
+				results = append(results, checkNode(r.role, node, channel, r.probe))
+			}
+		}
+	}
+
+	passed := true
+	fmt.Printf("%-9s %-30s %-16s %10s %4s %5s %8s %s\n", "role", "address", "channel", "dial(ms)", "tls", "probe", "identity", "detail")
+	for _, r := range results {
+		fmt.Printf("%-9s %-30s %-16s %10s %4s %5s %8s %s\n", r.role, r.address, r.channel, r.dial, r.tls, r.probe, r.identity, r.detail)
+		passed = passed && r.passed()
+	}
+	return passed
+}
+
+// checkNode checks the connection, TLS handshake and identity of one node with 'probe'.
+// 'probe' returns whether the node rejects the identity, and an error if the probe fails.
+func checkNode(role string, node Node, channel string, probe func(node Node, channel string) (bool, error)) *checkResult {
+	r := &checkResult{
+		role:     role,
+		address:  node.Address,
+		channel:  channel,
+		dial:     "FAIL",
+		tls:      "-",
+		probe:    "-",
+		identity: "-",
+	}
+
+	if node.TLSCACertByte != nil || node.TLSClientCertByte != nil {
+		if err := checkTLSHandshake(node); err != nil {
+			r.tls = "FAIL"
+			r.detail = err.Error()
+			return r
+		}
+		r.tls = "ok"
+	}
+
+	start := time.Now()
+	conn, err := DialConnection(node)
+	if err != nil {
+		r.detail = err.Error()
+		return r
+	}
+	conn.Close()
+	r.dial = fmt.Sprintf("%.2f", float64(time.Since(start).Microseconds())/1e3)
+
+	rejected, err := probe(node, channel)
+	if rejected {
+		r.identity = "REJECTED"
+	}
+	if err != nil {
+		r.probe = "FAIL"
+		r.detail = err.Error()
+		return r
+	}
+	r.probe = "ok"
+	r.identity = "accepted"
+	return r
+}
+
+// probeEndorser sends a proposal querying the chain info to the endorser, which is never committed
+func probeEndorser(node Node, channel string) (bool, error) {
+	client, conn, err := CreateEndorserClient(node)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	proposal, _, err := CreateProposal("", channel, "qscc", "", []string{"GetChainInfo", channel}, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "fail to create test proposal")
+	}
+	signedProposal, err := SignProposal(proposal)
+	if err != nil {
+		return false, errors.Wrap(err, "fail to sign test proposal")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	resp, err := client.ProcessProposal(ctx, signedProposal)
+	if err != nil {
+		return false, errors.Wrap(err, "fail to process test proposal")
+	}
+	if resp.Response.Status != 200 {
+		// The peer answers 500 with an access denied message if the creator is not accepted,
+		// any other failure, e.g. of the channel, says nothing about the identity
+		rejected := strings.Contains(resp.Response.Message, "access denied")
+		return rejected, errors.Errorf("test proposal status %d: %s", resp.Response.Status, resp.Response.Message)
+	}
+	return false, nil
+}
+
+// probePeerDeliver seeks the newest block from the committer
+func probePeerDeliver(node Node, channel string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	conn, err := DialConnection(node)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	client, err := peer.NewDeliverClient(conn).DeliverFiltered(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "fail to create deliver stream")
+	}
+	if err = sendNewestSeek(client, channel); err != nil {
+		return false, err
+	}
+
+	resp, err := client.Recv()
+	if err != nil {
+		return false, errors.Wrap(err, "fail to receive deliver response")
+	}
+	if status, ok := resp.Type.(*peer.DeliverResponse_Status); ok {
+		return checkDeliverStatus(status.Status)
+	}
+	return false, nil
+}
+
+// probeOrdererDeliver seeks the newest block from the orderer, without broadcasting anything
+func probeOrdererDeliver(node Node, channel string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	conn, err := DialConnection(node)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	client, err := orderer.NewAtomicBroadcastClient(conn).Deliver(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "fail to create deliver stream")
+	}
+	if err = sendNewestSeek(client, channel); err != nil {
+		return false, err
+	}
+
+	resp, err := client.Recv()
+	if err != nil {
+		return false, errors.Wrap(err, "fail to receive deliver response")
+	}
+	if status, ok := resp.Type.(*orderer.DeliverResponse_Status); ok {
+		return checkDeliverStatus(status.Status)
+	}
+	return false, nil
+}
+
+func sendNewestSeek(client interface{ Send(*common.Envelope) error }, channel string) error {
+	envelope, err := CreateSignedDeliverNewestEnv(channel)
+	if err != nil {
+		return errors.Wrap(err, "fail to create seek envelope")
+	}
+	if err = client.Send(envelope); err != nil {
+		return errors.Wrap(err, "fail to send seek envelope")
+	}
+	return nil
+}
+
+// checkDeliverStatus returns whether the status means the identity is rejected,
+// since a Deliver seek is answered with a status before any block only on failure
+func checkDeliverStatus(status common.Status) (bool, error) {
+	return status == common.Status_FORBIDDEN, errors.Errorf("deliver status %s", status)
+}
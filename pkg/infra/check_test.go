@@ -0,0 +1,97 @@
+package infra
+
+import (
+	"net"
+	"testing"
+
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCheckDeliverStatus(t *testing.T) {
+	tests := []struct {
+		status       common.Status
+		wantRejected bool
+	}{
+		{common.Status_FORBIDDEN, true},
+		{common.Status_NOT_FOUND, false},
+		{common.Status_SERVICE_UNAVAILABLE, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status.String(), func(t *testing.T) {
+			rejected, err := checkDeliverStatus(tt.status)
+			if rejected != tt.wantRejected {
+				t.Errorf("rejected = %v, want %v", rejected, tt.wantRejected)
+			}
+			if err == nil {
+				t.Errorf("status %s is not reported as an error", tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckNode(t *testing.T) {
+	node, stop := serveOrderer(t, &fakeOrdererServer{})
+	defer stop()
+
+	// An address which refuses connections
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen: %v", err)
+	}
+	lis.Close()
+	down := Node{Address: lis.Addr().String(), GRPC: GRPCOptions{DialTimeout: 100}}
+
+	probeOK := func(Node, string) (bool, error) { return false, nil }
+	probeRejected := func(Node, string) (bool, error) { return true, errors.New("access denied") }
+	probeFailed := func(Node, string) (bool, error) { return false, errors.New("channel not found") }
+
+	tests := []struct {
+		name         string
+		node         Node
+		probe        func(Node, string) (bool, error)
+		wantPassed   bool
+		wantProbe    string
+		wantIdentity string
+	}{
+		{"accepted", node, probeOK, true, "ok", "accepted"},
+		{"identity rejected", node, probeRejected, false, "FAIL", "REJECTED"},
+		{"probe fails", node, probeFailed, false, "FAIL", "-"},
+		{"unreachable", down, probeOK, false, "-", "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := checkNode("orderer", tt.node, "test", tt.probe)
+			if r.passed() != tt.wantPassed {
+				t.Errorf("passed() = %v, want %v, detail %q", r.passed(), tt.wantPassed, r.detail)
+			}
+			if r.probe != tt.wantProbe || r.identity != tt.wantIdentity {
+				t.Errorf("probe %q and identity %q, want %q and %q", r.probe, r.identity, tt.wantProbe, tt.wantIdentity)
+			}
+			if r.tls != "-" {
+				t.Errorf("tls = %q without TLS", r.tls)
+			}
+			if (r.dial == "FAIL") != (tt.node.Address == down.Address) {
+				t.Errorf("dial = %q to %s", r.dial, tt.node.Address)
+			}
+		})
+	}
+}
+
+func TestCheckQueryMode(t *testing.T) {
+	defer func(c *Config, l *log.Logger) { config, logger = c, l }(config, logger)
+
+	// Neither the committer nor the orderer is given in query mode, so there is nothing to dial
+	c := &Config{
+		Query:      true,
+		Channels:   []string{"test"},
+		Committers: []Node{{}},
+		Orderers:   []Node{{}},
+	}
+	if !Check(c, log.New()) {
+		t.Errorf("Check() = false, want the nodes left out in query mode to be skipped")
+	}
+}
@@ -3,9 +3,12 @@ package infra
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"math"
+	"net"
 	"time"
 
-	"github.com/GwanWingYan/fabric-protos-go/orderer"
+	"github.com/GwanWingYan/fabric-protos-go/common"
 	"github.com/GwanWingYan/fabric-protos-go/peer"
 	"github.com/GwanWingYan/tape/pkg/comm"
 	"github.com/pkg/errors"
@@ -14,8 +17,33 @@ import (
 
 const (
 	MAX_TRY = 3
+
+	defaultDialTimeout = 5 * time.Second
+	// noKeepalive is the keepalive interval which never elapses, since gRPC raises an interval of 0 to 10 seconds
+	noKeepalive = time.Duration(math.MaxInt64)
+
+	// http2ClientPreface is the first bytes a gRPC client sends after the TLS handshake
+	http2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 )
 
+// GRPCOptions tunes the gRPC connections to a node
+type GRPCOptions struct {
+	DialTimeout        int    `yaml:"dialTimeout"`        // milliseconds to wait for a connection, 5000 by default
+	KeepaliveInterval  int    `yaml:"keepaliveInterval"`  // seconds without activity before pinging the node, at least 10 (gRPC raises shorter ones), 0 to disable keepalive
+	KeepaliveTimeout   int    `yaml:"keepaliveTimeout"`   // seconds to wait for the ping response, 20 by default
+	MaxRecvMsgSize     int    `yaml:"maxRecvMsgSize"`     // maximum bytes of a received message, 100MB by default
+	MaxSendMsgSize     int    `yaml:"maxSendMsgSize"`     // maximum bytes of a sent message, 100MB by default
+	ServerNameOverride string `yaml:"serverNameOverride"` // server name to verify the TLS certificate against, the host of the address by default
+	VerifyTLS          bool   `yaml:"verifyTLS"`          // if true, verify the TLS certificate of the node against 'tlsCACert', otherwise accept any certificate
+}
+
+func (o *GRPCOptions) valid() error {
+	if o.DialTimeout < 0 || o.KeepaliveInterval < 0 || o.KeepaliveTimeout < 0 || o.MaxRecvMsgSize < 0 || o.MaxSendMsgSize < 0 {
+		return errors.New("timeouts, intervals and message sizes must not be negative")
+	}
+	return nil
+}
+
 func newGRPCClient(node Node) (*comm.GRPCClient, error) {
 	clientConfig := generateClientConfig(node)
 
@@ -24,14 +52,41 @@ func newGRPCClient(node Node) (*comm.GRPCClient, error) {
 		return nil, errors.Wrapf(err, "error connecting to %s", node.Address)
 	}
 
+	if node.GRPC.MaxRecvMsgSize > 0 {
+		grpcClient.SetMaxRecvMsgSize(node.GRPC.MaxRecvMsgSize)
+	}
+	if node.GRPC.MaxSendMsgSize > 0 {
+		grpcClient.SetMaxSendMsgSize(node.GRPC.MaxSendMsgSize)
+	}
+
 	return grpcClient, nil
 }
 
+// dialTimeout returns how long to wait for a connection to the node
+func dialTimeout(node Node) time.Duration {
+	if node.GRPC.DialTimeout > 0 {
+		return time.Duration(node.GRPC.DialTimeout) * time.Millisecond
+	}
+	return defaultDialTimeout
+}
+
+// keepaliveInterval returns how long the connection to the node is idle before pinging the node
+func keepaliveInterval(node Node) time.Duration {
+	if node.GRPC.KeepaliveInterval > 0 {
+		return time.Duration(node.GRPC.KeepaliveInterval) * time.Second
+	}
+	return noKeepalive
+}
+
 func generateClientConfig(node Node) comm.ClientConfig {
 	certs := collectTLSCACertsBytes(node)
 
 	clientConfig := comm.ClientConfig{
-		Timeout: 5 * time.Second,
+		Timeout: dialTimeout(node),
+		KaOpts: comm.KeepaliveOptions{
+			ClientInterval: keepaliveInterval(node),
+			ClientTimeout:  time.Duration(node.GRPC.KeepaliveTimeout) * time.Second,
+		},
 		SecOpts: comm.SecureOptions{
 			UseTLS:            false,
 			RequireClientCert: false,
@@ -39,15 +94,12 @@ func generateClientConfig(node Node) comm.ClientConfig {
 		},
 	}
 
-	if len(certs) > 0 {
+	if len(certs) > 0 || node.TLSClientCertByte != nil {
 		clientConfig.SecOpts.UseTLS = true
-		if len(node.TLSCAKey) > 0 && len(node.TLSCARoot) > 0 {
+		if node.TLSClientCertByte != nil {
 			clientConfig.SecOpts.RequireClientCert = true
-			clientConfig.SecOpts.Certificate = node.TLSCACertByte
-			clientConfig.SecOpts.Key = node.TLSCAKeyByte
-			if node.TLSCARootByte != nil {
-				clientConfig.SecOpts.ClientRootCAs = append(clientConfig.SecOpts.ClientRootCAs, node.TLSCARootByte)
-			}
+			clientConfig.SecOpts.Certificate = node.TLSClientCertByte
+			clientConfig.SecOpts.Key = node.TLSClientKeyByte
 		}
 	}
 
@@ -62,28 +114,43 @@ func collectTLSCACertsBytes(node Node) [][]byte {
 	return certs
 }
 
-func CreateEndorserClient(node Node) (peer.EndorserClient, error) {
+// CreateEndorserClient creates an endorser client with the connection under it, which the caller closes
+func CreateEndorserClient(node Node) (peer.EndorserClient, *grpc.ClientConn, error) {
 	conn, err := DialConnection(node)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return peer.NewEndorserClient(conn), nil
+	return peer.NewEndorserClient(conn), conn, nil
+}
+
+// DeliverClient is a filtered block, full block or block-and-private-data deliver stream
+type DeliverClient interface {
+	Send(*common.Envelope) error
+	Recv() (*peer.DeliverResponse, error)
 }
 
-func CreateBroadcastClient(node Node) (orderer.AtomicBroadcast_BroadcastClient, error) {
+// CreateDeliverClient creates a deliver stream according to the deliver mode,
+// with the connection under it, which the caller closes
+func CreateDeliverClient(node Node) (DeliverClient, *grpc.ClientConn, error) {
 	conn, err := DialConnection(node)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return orderer.NewAtomicBroadcastClient(conn).Broadcast(context.Background())
-}
 
-func CreateDeliverFilteredClient() (peer.Deliver_DeliverFilteredClient, error) {
-	conn, err := DialConnection(config.Committer)
+	var deliverer DeliverClient
+	switch config.DeliverMode {
+	case "filtered":
+		deliverer, err = peer.NewDeliverClient(conn).DeliverFiltered(context.Background())
+	case "private":
+		deliverer, err = peer.NewDeliverClient(conn).DeliverWithPrivateData(context.Background())
+	default:
+		deliverer, err = peer.NewDeliverClient(conn).Deliver(context.Background())
+	}
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, nil, err
 	}
-	return peer.NewDeliverClient(conn).DeliverFiltered(context.Background())
+	return deliverer, conn, nil
 }
 
 func DialConnection(node Node) (*grpc.ClientConn, error) {
@@ -92,16 +159,112 @@ func DialConnection(node Node) (*grpc.ClientConn, error) {
 		return nil, err
 	}
 
-	for i := 1; i <= MAX_TRY; i++ {
-		conn, err := gRPCClient.NewConnection(
-			node.Address,
-			func(tlsConfig *tls.Config) {
-				tlsConfig.InsecureSkipVerify = true
-			},
-		)
+	var tlsOptions []comm.TLSOption
+	if node.GRPC.ServerNameOverride != "" {
+		tlsOptions = append(tlsOptions, comm.ServerNameOverride(node.GRPC.ServerNameOverride))
+	}
+	if !node.GRPC.VerifyTLS {
+		tlsOptions = append(tlsOptions, func(tlsConfig *tls.Config) {
+			tlsConfig.InsecureSkipVerify = true
+		})
+	}
+
+	// Retry with exponential backoff, since a busy node may refuse connections for a while
+	backoff := minReconnectBackoff
+	for i := 1; ; i++ {
+		conn, err := gRPCClient.NewConnection(node.Address, tlsOptions...)
 		if err == nil {
 			return conn, nil
 		}
+		if i == MAX_TRY {
+			return nil, errors.Wrapf(err, "failed to dial %s after %d attempts", node.Address, MAX_TRY)
+		}
+
+		logger.Warnf("Fail to dial %s, retry in %v: %v", node.Address, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// tlsConfigOf returns the TLS config which the gRPC connections to the node use
+func tlsConfigOf(node Node) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         node.GRPC.ServerNameOverride,
+		InsecureSkipVerify: !node.GRPC.VerifyTLS,
+		NextProtos:         []string{"h2"},
+	}
+
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(node.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid address %s", node.Address)
+		}
+		tlsConfig.ServerName = host
+	}
+
+	if node.TLSCACertByte != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if err := comm.AddPemToCertPool(node.TLSCACertByte, tlsConfig.RootCAs); err != nil {
+			return nil, errors.WithMessage(err, "invalid TLS CA cert")
+		}
+	}
+
+	if node.TLSClientCertByte != nil {
+		cert, err := tls.X509KeyPair(node.TLSClientCertByte, node.TLSClientKeyByte)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid client TLS cert or key")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// checkTLSHandshake completes a TLS handshake with the node, so that a misconfigured certificate
+// is reported clearly instead of as a failure to dial
+func checkTLSHandshake(node Node) error {
+	tlsConfig, err := tlsConfigOf(node)
+	if err != nil {
+		return err
+	}
+
+	timeout := dialTimeout(node)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", node.Address, tlsConfig)
+	if err != nil {
+		return errors.Wrap(err, "TLS handshake fails")
+	}
+	defer conn.Close()
+
+	// With TLS 1.3, the node rejects the client certificate only after the handshake completes
+	// on our side, so wait for its first answer to the gRPC connection
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write([]byte(http2ClientPreface)); err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err != nil {
+		if tlsConfig.Certificates != nil {
+			return errors.Wrap(err, "connection is closed after the TLS handshake, the client TLS certificate may be rejected")
+		}
+		return errors.Wrap(err, "connection is closed after the TLS handshake, the node may require mutual TLS")
+	}
+
+	return nil
+}
+
+// mustCheckTLS checks the TLS handshake with every node using TLS before the run
+func mustCheckTLS() {
+	checked := make(map[string]bool)
+	nodes := append(append(append([]Node{}, config.Endorsers...), config.Committers...), config.Orderers...)
+	for _, node := range nodes {
+		if checked[node.Address] || node.TLSCACertByte == nil && node.TLSClientCertByte == nil {
+			continue
+		}
+		checked[node.Address] = true
+
+		if err := checkTLSHandshake(node); err != nil {
+			logger.Fatalf("Fail to connect to %s: %v", node.Address, err)
+		}
+		logger.Infof("TLS handshake with %s succeeds", node.Address)
 	}
-	return nil, errors.Wrapf(err, "failed to dial %s: %s", node.Address)
 }
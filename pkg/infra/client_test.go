@@ -0,0 +1,134 @@
+package infra
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// selfSignedPair returns a PEM encoded self-signed certificate for 'host' and its private key
+func selfSignedPair(t *testing.T, host string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Fail to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Fail to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Fail to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestGenerateClientConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		node         Node
+		wantTimeout  time.Duration
+		wantInterval time.Duration
+		wantTLS      bool
+	}{
+		// gRPC raises an interval of 0 to 10 seconds, so keepalive is disabled by an interval which never elapses
+		{"defaults", Node{}, 5 * time.Second, noKeepalive, false},
+		{"dial timeout", Node{GRPC: GRPCOptions{DialTimeout: 300}}, 300 * time.Millisecond, noKeepalive, false},
+		{"keepalive", Node{GRPC: GRPCOptions{KeepaliveInterval: 30, KeepaliveTimeout: 5}}, 5 * time.Second, 30 * time.Second, false},
+		{"tls", Node{TLSCACertByte: []byte("cert")}, 5 * time.Second, noKeepalive, true},
+		{"client cert only", Node{TLSClientCertByte: []byte("cert"), TLSClientKeyByte: []byte("key")}, 5 * time.Second, noKeepalive, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := generateClientConfig(tt.node)
+			if c.Timeout != tt.wantTimeout {
+				t.Errorf("Timeout = %v, want %v", c.Timeout, tt.wantTimeout)
+			}
+			if c.KaOpts.ClientInterval != tt.wantInterval {
+				t.Errorf("ClientInterval = %v, want %v", c.KaOpts.ClientInterval, tt.wantInterval)
+			}
+			if want := time.Duration(tt.node.GRPC.KeepaliveTimeout) * time.Second; c.KaOpts.ClientTimeout != want {
+				t.Errorf("ClientTimeout = %v, want %v", c.KaOpts.ClientTimeout, want)
+			}
+			if c.SecOpts.UseTLS != tt.wantTLS {
+				t.Errorf("UseTLS = %v, want %v", c.SecOpts.UseTLS, tt.wantTLS)
+			}
+		})
+	}
+}
+
+func TestGRPCOptionsValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		options GRPCOptions
+		wantErr bool
+	}{
+		{"zero values", GRPCOptions{}, false},
+		{"all set", GRPCOptions{DialTimeout: 1000, KeepaliveInterval: 10, KeepaliveTimeout: 20, MaxRecvMsgSize: 1 << 20, MaxSendMsgSize: 1 << 20}, false},
+		{"negative dial timeout", GRPCOptions{DialTimeout: -1}, true},
+		{"negative message size", GRPCOptions{MaxSendMsgSize: -1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.valid(); (err != nil) != tt.wantErr {
+				t.Errorf("valid() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSConfigOf(t *testing.T) {
+	cert, key := selfSignedPair(t, "peer0")
+	_, otherKey := selfSignedPair(t, "peer0")
+
+	tests := []struct {
+		name           string
+		node           Node
+		wantErr        bool
+		wantServerName string
+		wantCerts      int
+	}{
+		{"server name from address", Node{Address: "peer0.org1:7051"}, false, "peer0.org1", 0},
+		{"server name override", Node{Address: "127.0.0.1:7051", GRPC: GRPCOptions{ServerNameOverride: "peer0"}}, false, "peer0", 0},
+		{"address without port", Node{Address: "peer0"}, true, "", 0},
+		{"client pair", Node{Address: "peer0:7051", TLSClientCertByte: cert, TLSClientKeyByte: key}, false, "peer0", 1},
+		{"mismatched client pair", Node{Address: "peer0:7051", TLSClientCertByte: cert, TLSClientKeyByte: otherKey}, true, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := tlsConfigOf(tt.node)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tlsConfigOf() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tlsConfig.ServerName != tt.wantServerName {
+				t.Errorf("ServerName = %q, want %q", tlsConfig.ServerName, tt.wantServerName)
+			}
+			if len(tlsConfig.Certificates) != tt.wantCerts {
+				t.Errorf("%d client certificates, want %d", len(tlsConfig.Certificates), tt.wantCerts)
+			}
+			if tlsConfig.InsecureSkipVerify == tt.node.GRPC.VerifyTLS {
+				t.Errorf("InsecureSkipVerify = %v with VerifyTLS %v", tlsConfig.InsecureSkipVerify, tt.node.GRPC.VerifyTLS)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package infra
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// completions[i] is closed when the i-th transaction completes,
+	// only used in the closed-loop mode
+	completions []chan struct{}
+	completed   []int32
+)
+
+// ClosedLoopConfig configures the closed-loop mode, in which a fixed number of
+// virtual clients each submit a transaction and wait for it before sending the next one
+type ClosedLoopConfig struct {
+	Clients   int    `yaml:"clients"`   // number of virtual clients, 0 to disable the closed-loop mode
+	WaitFor   string `yaml:"waitFor"`   // what a client waits for before the next transaction ['commit', 'endorsement']
+	ThinkTime int    `yaml:"thinkTime"` // milliseconds a client waits after a transaction completes
+}
+
+func isClosedLoop() bool {
+	return config.ClosedLoop.Clients > 0
+}
+
+func initCompletions() {
+	completions = nil
+	completed = nil
+	if !isClosedLoop() {
+		return
+	}
+
+	completions = make([]chan struct{}, config.TxNum)
+	completed = make([]int32, config.TxNum)
+	for i := range completions {
+		completions[i] = make(chan struct{})
+	}
+}
+
+// completeTx wakes up the virtual client waiting for the transaction.
+// It is safe to call it more than once for the same transaction.
+func completeTx(txid string) {
+	if completions == nil {
+		return
+	}
+
+	id, ok := txid2id[txid]
+	if !ok {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&completed[id], 0, 1) {
+		close(completions[id])
+	}
+}
+
+// completeEndorsedTx completes the transaction if the virtual clients only wait for endorsement
+func completeEndorsedTx(txid string) {
+	if config.ClosedLoop.WaitFor == "endorsement" {
+		completeTx(txid)
+	}
+}
+
+type VirtualClients struct {
+	clients []*VirtualClient
+}
+
+func NewVirtualClients(inCh chan *Element, outCh chan *Element) *VirtualClients {
+	clients := make([]*VirtualClient, config.ClosedLoop.Clients)
+	for i := range clients {
+		clients[i] = &VirtualClient{
+			clientIndex: i,
+			inCh:        inCh,
+			outCh:       outCh,
+		}
+	}
+
+	return &VirtualClients{clients: clients}
+}
+
+// StartAsync starts a goroutine for every virtual client
+func (vcs *VirtualClients) StartAsync() {
+	logger.Infof("Start %d virtual clients, each waiting for %s", len(vcs.clients), config.ClosedLoop.WaitFor)
+
+	for _, vc := range vcs.clients {
+		goWorker(vc.Start)
+	}
+}
+
+type VirtualClient struct {
+	clientIndex int
+	inCh        chan *Element
+	outCh       chan *Element
+	latencies   []int64 // latency of each completed transaction in nanosecond
+	lock        sync.Mutex
+}
+
+// Start submits transactions one by one, each after the previous one completes
+func (vc *VirtualClient) Start() {
+	thinkTime := time.Duration(config.ClosedLoop.ThinkTime) * time.Millisecond
+
+	for {
+		select {
+		case element := <-vc.inCh:
+			id := txid2id[element.Txid]
+			submittedTime := time.Now()
+			select {
+			case vc.outCh <- element:
+			case <-doneCh:
+				return
+			}
+
+			select {
+			case <-completions[id]:
+				vc.lock.Lock()
+				vc.latencies = append(vc.latencies, time.Since(submittedTime).Nanoseconds())
+				vc.lock.Unlock()
+			case <-doneCh:
+				return
+			}
+
+			if thinkTime > 0 {
+				time.Sleep(thinkTime)
+			}
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+// report writes the latency of each virtual client to the report
+func (vcs *VirtualClients) report(duration time.Duration) {
+	latencies := make([][]int64, len(vcs.clients))
+	var all []int64
+	for i, vc := range vcs.clients {
+		vc.lock.Lock()
+		latencies[i] = append([]int64(nil), vc.latencies...)
+		vc.lock.Unlock()
+		all = append(all, latencies[i]...)
+	}
+
+	reportCh <- fmt.Sprintf("Closed-loop Clients: %d, Completed: %d, Throughput: %.2f tx/s, Average Latency: %.2fms, P99 Latency: %.2fms",
+		len(vcs.clients),
+		len(all),
+		float64(len(all))/duration.Seconds(),
+		averageLatencyMs(all),
+		percentileMs(all, 99),
+	)
+
+	reportCh <- fmt.Sprintf("client completed avg(ms) p50(ms) p99(ms)")
+	for i, vc := range vcs.clients {
+		reportCh <- fmt.Sprintf("%-6d %9d %7.2f %7.2f %7.2f",
+			vc.clientIndex,
+			len(latencies[i]),
+			averageLatencyMs(latencies[i]),
+			percentileMs(latencies[i], 50),
+			percentileMs(latencies[i], 99),
+		)
+	}
+}
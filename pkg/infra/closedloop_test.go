@@ -0,0 +1,97 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCompleteTx(t *testing.T) {
+	defer func(c *Config, m map[string]int, cs []chan struct{}, cd []int32) {
+		config, txid2id, completions, completed = c, m, cs, cd
+	}(config, txid2id, completions, completed)
+
+	config = &Config{TxNum: 2, ClosedLoop: ClosedLoopConfig{Clients: 1, WaitFor: "commit"}}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1}
+	initCompletions()
+
+	// Completing a transaction twice, or one tape never generated, must not panic
+	completeTx("tx0")
+	completeTx("tx0")
+	completeTx("unknown")
+
+	select {
+	case <-completions[0]:
+	default:
+		t.Errorf("tx0 is not completed")
+	}
+	select {
+	case <-completions[1]:
+		t.Errorf("tx1 is completed, want it to be pending")
+	default:
+	}
+
+	// Endorsement does not complete a transaction waiting for commit
+	completeEndorsedTx("tx1")
+	select {
+	case <-completions[1]:
+		t.Errorf("tx1 is completed by endorsement, want it to wait for commit")
+	default:
+	}
+
+	config.ClosedLoop.WaitFor = "endorsement"
+	completeEndorsedTx("tx1")
+	select {
+	case <-completions[1]:
+	default:
+		t.Errorf("tx1 is not completed by endorsement")
+	}
+}
+
+func TestVirtualClientWaitsForCompletion(t *testing.T) {
+	defer func(c *Config, m map[string]int, cs []chan struct{}, cd []int32, d chan struct{}, l *log.Logger) {
+		config, txid2id, completions, completed, doneCh, logger = c, m, cs, cd, d, l
+	}(config, txid2id, completions, completed, doneCh, logger)
+
+	logger = log.New()
+	config = &Config{TxNum: 2, ClosedLoop: ClosedLoopConfig{Clients: 1, WaitFor: "commit"}}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1}
+	doneCh = make(chan struct{})
+	initCompletions()
+
+	inCh := make(chan *Element, 2)
+	outCh := make(chan *Element, 2)
+	inCh <- &Element{Txid: "tx0"}
+	inCh <- &Element{Txid: "tx1"}
+
+	vcs := NewVirtualClients(inCh, outCh)
+	vcs.StartAsync()
+	defer close(doneCh)
+
+	if e := <-outCh; e.Txid != "tx0" {
+		t.Fatalf("the first transaction submitted is %s, want tx0", e.Txid)
+	}
+	select {
+	case e := <-outCh:
+		t.Fatalf("%s is submitted before tx0 completes", e.Txid)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	completeTx("tx0")
+	select {
+	case e := <-outCh:
+		if e.Txid != "tx1" {
+			t.Errorf("the second transaction submitted is %s, want tx1", e.Txid)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("tx1 is not submitted after tx0 completes")
+	}
+
+	vc := vcs.clients[0]
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	if len(vc.latencies) != 1 || vc.latencies[0] < int64(50*time.Millisecond) {
+		t.Errorf("latencies = %v, want one latency of at least 50ms", vc.latencies)
+	}
+}
@@ -1,8 +1,16 @@
 package infra
 
 import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 
 	"github.com/GwanWingYan/fabric-protos-go/msp"
 	"github.com/gogo/protobuf/proto"
@@ -12,52 +20,87 @@ import (
 
 var (
 	itemNotProvidedError = errors.New("No such item")
+
+	// unknownFieldPattern matches the errors of yaml.UnmarshalStrict about unknown fields
+	unknownFieldPattern = regexp.MustCompile(`^line \d+: field .* not found in type `)
 )
 
 type Node struct {
-	Address       string `yaml:"address"`
-	TLSCACert     string `yaml:"tlsCACert"`
-	TLSCAKey      string `yaml:"tlsCAKey"`
-	TLSCARoot     string `yaml:"tlsCARoot"`
-	TLSCACertByte []byte
-	TLSCAKeyByte  []byte
-	TLSCARootByte []byte
+	Address           string      `yaml:"address"`
+	TLSCACert         string      `yaml:"tlsCACert"`     // CA certificate which the TLS certificate of the node is issued by
+	TLSClientCert     string      `yaml:"tlsClientCert"` // client TLS certificate for mutual TLS, 'tlsClientCert' of the config by default
+	TLSClientKey      string      `yaml:"tlsClientKey"`  // client TLS private key for mutual TLS, 'tlsClientKey' of the config by default
+	TLSCAKey          string      `yaml:"tlsCAKey"`      // deprecated, ignored
+	TLSCARoot         string      `yaml:"tlsCARoot"`     // deprecated, ignored
+	Org               string      `yaml:"org"`           // organization of the node, which endorsements can be hedged within
+	GRPC              GRPCOptions `yaml:"grpc"`          // tuning of the gRPC connections to the node
+	TLSCACertByte     []byte      `yaml:"-"`
+	TLSClientCertByte []byte      `yaml:"-"`
+	TLSClientKeyByte  []byte      `yaml:"-"`
 }
 
 type Config struct {
 	// Network
-	Endorsers []Node `yaml:"endorsers"` // peers
-	Committer Node   `yaml:"committer"` // the peer chosen to observe blocks from
-	Orderer   Node   `yaml:"orderer"`   // orderer
-	Channel   string `yaml:"channel"`   // name of the channel to be operated on
+	ConnectionProfile string `yaml:"connectionProfile"` // common connection profile filling in the nodes and identity not provided
+
+	Endorsers     []Node `yaml:"endorsers"`     // peers
+	Committer     Node   `yaml:"committer"`     // the peer chosen to observe blocks from, if 'committers' is not provided
+	Committers    []Node `yaml:"committers"`    // the peers chosen to observe blocks from
+	CommitQuorum  int    `yaml:"commitQuorum"`  // number of committers on which a transaction must be observed, 0 for all
+	Orderer       Node   `yaml:"orderer"`       // the orderer to broadcast to, if 'orderers' is not provided
+	Orderers      []Node `yaml:"orderers"`      // the orderers to broadcast to
+	OrdererPolicy string `yaml:"ordererPolicy"` // how broadcasters are spread across orderers ['roundRobin', 'leader', 'random']
+	Channel       string `yaml:"channel"`       // name of the channel to be operated on, if 'targets' is not provided
 
 	// Chaincode
-	Chaincode string   `yaml:"chaincode"` // chaincode name
-	Version   string   `yaml:"version"`   // chaincode version
-	Args      []string `yaml:"args"`      // chaincode arguments
+	Chaincode string            `yaml:"chaincode"` // chaincode name, if 'targets' is not provided
+	Version   string            `yaml:"version"`   // chaincode version, if 'targets' is not provided
+	Args      []string          `yaml:"args"`      // chaincode arguments
+	Transient map[string]string `yaml:"transient"` // transient data, e.g. private data, passed to the chaincode, if not provided by the target
+	Targets   []Target          `yaml:"targets"`   // chaincodes on channels to send transactions to
+	Channels  []string          `yaml:"-"`         // channels of all targets
 
 	// Client identity
 	MSPID      string  `yaml:"mspid"`      // the MSP the client belongs
 	PrivateKey string  `yaml:"privateKey"` // client's private key
 	SignCert   string  `yaml:"signCert"`   // client's certificate
-	Identity   *Crypto // client's identity
+	Identity   *Crypto `yaml:"-"`          // client's identity
+
+	implicitTarget bool // the only target is made of 'channel', 'chaincode', 'txType', 'transient' and 'expect'
+
+	privateKeyPEM []byte // client's private key given inline by the connection profile
+	signCertPEM   []byte // client's certificate given inline by the connection profile
+
+	// Client TLS certificate and key for mutual TLS with every node, unless overridden by the node
+	TLSClientCert string `yaml:"tlsClientCert"`
+	TLSClientKey  string `yaml:"tlsClientKey"`
 
-	End2End bool `yaml:"e2e"` // running mode
+	End2End    bool             `yaml:"e2e"`        // running mode
+	Query      bool             `yaml:"query"`      // query mode, in which transactions are only endorsed, never ordered
+	Expect     Expectation      `yaml:"expect"`     // expected endorsement responses, if 'targets' is not provided
+	ClosedLoop ClosedLoopConfig `yaml:"closedLoop"` // closed-loop mode, which ignores 'rate' and 'rateProfile' if enabled
+	Search     SearchConfig     `yaml:"search"`     // used by 'tape search' only
+	Discovery  DiscoveryConfig  `yaml:"discovery"`  // discover endorsers and orderers from a peer instead of listing them
 
-	Rate  int `yaml:"rate"`  // average speed of transaction generation
-	Burst int `yaml:"burst"` // maximum speed of transaction generation
+	Rate        int     `yaml:"rate"`        // average speed of transaction generation
+	Burst       int     `yaml:"burst"`       // maximum speed of transaction generation
+	RateProfile []Phase `yaml:"rateProfile"` // load shape, which overrides 'rate' if provided
 
 	TxNum  int    `yaml:"txNum"`  // number of transactions
 	TxTime int    `yaml:"txTime"` // maximum execution time
-	TxType string `yaml:"txType"` // transaction type ['put', 'conflict']
+	TxType string `yaml:"txType"` // transaction type ['put', 'conflict'], if not provided by the target
 
-	ConnNum          int `yaml:"connNum"`          // number of connection
-	ClientPerConnNum int `yaml:"clientPerConnNum"` // number of client per connection
-	SignerNum        int `yaml:"signerNum"`        // number of signer
-	IntegratorNum    int `yaml:"integratorNum"`    // number of integrator
-	BroadcasterNum   int `yaml:"broadcasterNum"`   // number of orderer client
-	EndorserNum      int // number of endorsers
-	EndorserGroupNum int `yaml:"endorserGroupNum"` // number of endorser group
+	BroadcastRetry BroadcastRetryConfig `yaml:"broadcastRetry"` // how envelopes failing at the orderer are handled
+	Timeout        TimeoutConfig        `yaml:"timeout"`        // deadlines of endorsement and broadcast
+
+	ConnNum           int `yaml:"connNum"`          // number of connection
+	ClientPerConnNum  int `yaml:"clientPerConnNum"` // number of client per connection
+	SignerNum         int `yaml:"signerNum"`        // number of signer
+	IntegratorNum     int `yaml:"integratorNum"`    // number of integrator
+	BroadcasterNum    int `yaml:"broadcasterNum"`   // number of orderer client
+	EndorserNum       int `yaml:"-"`                // number of endorsers
+	EndorserGroupNum  int `yaml:"endorserGroupNum"` // number of endorser group
+	EndorsersPerGroup int `yaml:"-"`                // number of endorsers in each group, i.e. responses every transaction waits for
 
 	// If true, let the protoutil generate txid automatically
 	// If false, encode the txid by us
@@ -65,87 +108,416 @@ type Config struct {
 	// protoutil/proputils.go:ComputeTxID (v2) before compilation
 	CheckTxID bool `yaml:"checkTxID"`
 
-	// If true, print the read set and write set to STDOUT
+	// If true, write the read set and write set of every transaction to 'rwsetPath'
 	CheckRWSet bool `yaml:"checkRWSet"`
 
-	LogPath    string `yaml:"logPath"`    // path of the log file
-	ReportPath string `yaml:"reportPath"` // path of the report file
+	LogPath        string `yaml:"logPath"`        // path of the log file
+	ReportPath     string `yaml:"reportPath"`     // path of the report file
+	TimeSeriesPath string `yaml:"timeSeriesPath"` // path of the per-second time series file
+	RWSetPath      string `yaml:"rwsetPath"`      // path of the read/write set file, one JSON object per line
+
+	DeliverMode    string          `yaml:"deliverMode"`    // how the observers receive blocks ['filtered', 'full', 'private']
+	BatchSize      BatchSizeConfig `yaml:"batchSize"`      // 'BatchSize' of the orderer, used to infer the block cut reason with full blocks
+	BlockStatsPath string          `yaml:"blockStatsPath"` // path of the block statistics file with full blocks
+	ConflictPath   string          `yaml:"conflictPath"`   // path of the confirmed conflict file with full blocks
+
+	ObserverTimeout   int     `yaml:"observerTimeout"`   // seconds without any new block before the observer stops waiting, 20 by default
+	Completion        string  `yaml:"completion"`        // when the run completes ['broadcast', 'submitted', 'percentage']
+	CompletionPercent float64 `yaml:"completionPercent"` // percentage of transactions to be observed in the 'percentage' mode
+
+	WarmUp   int `yaml:"warmUp"`   // seconds excluded from the beginning when computing steady-state TPS
+	CoolDown int `yaml:"coolDown"` // seconds excluded from the end when computing steady-state TPS
 
 	Seed int `yaml:"seed"` // random seed
 }
 
-func (c *Config) mustLoadRawConfigFromFile(filename string) {
+// rawConfig accepts the top-level keys which are not fields of the config only if they define anchors,
+// e.g. the nodes referred to by 'endorsers', so that typos are still reported
+type rawConfig struct {
+	Config  `yaml:",inline"`
+	Anchors map[string]interface{} `yaml:",inline"`
+}
+
+func (c *Config) loadRawConfigFromFile(filename string) error {
 	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
-		logger.Panicf("Fail to load %s: %v", filename, err)
+		return errors.Wrapf(err, "fail to load %s", filename)
 	}
 
-	err = yaml.Unmarshal(raw, c)
-	if err != nil {
-		logger.Panicf("Fail to unmarshal %s: %v", filename, err)
+	errs := &validationError{}
+	rc := &rawConfig{}
+	if err = yaml.UnmarshalStrict(raw, rc); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return errors.Wrapf(err, "fail to unmarshal %s", filename)
+		}
+		// Unknown fields are reported with their paths below instead of the lines
+		for _, problem := range typeErr.Errors {
+			if !unknownFieldPattern.MatchString(problem) {
+				errs.problems = append(errs.problems, problem)
+			}
+		}
+	}
+
+	// Aliases are expanded in the document, so an unknown field of a node is reported where the node is used
+	var doc yaml.MapSlice
+	if err = yaml.Unmarshal(raw, &doc); err != nil {
+		return errors.Wrapf(err, "fail to unmarshal %s", filename)
+	}
+	configType := reflect.TypeOf(Config{})
+	for _, item := range doc {
+		key := fmt.Sprint(item.Key)
+		i, ok := fieldIndexByKey(configType, key, false)
+		if ok {
+			unknownFields(item.Value, configType.Field(i).Type, key, errs)
+			continue
+		}
+
+		// A key may be quoted, e.g. "peer1": &peer1
+		anchor := regexp.MustCompile(`(?m)^(` + regexp.QuoteMeta(key) + `|"` + regexp.QuoteMeta(key) + `"|'` + regexp.QuoteMeta(key) + `')\s*:\s*&`)
+		if !anchor.Match(raw) {
+			errs.addf(key, "unknown field, or a top-level node definition without an anchor")
+		}
+	}
+
+	*c = rc.Config
+	return errs.err()
+}
+
+// unknownFields reports every key in the YAML value 'v' which is not a field of type 't',
+// with the path from the top of the config, e.g. 'endorsers[0].addr'
+func unknownFields(v interface{}, t reflect.Type, path string, errs *validationError) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+		for _, item := range m {
+			key := fmt.Sprint(item.Key)
+			i, ok := fieldIndexByKey(t, key, false)
+			if !ok {
+				errs.addf(path+"."+key, "unknown field")
+				continue
+			}
+			unknownFields(item.Value, t.Field(i).Type, path+"."+key, errs)
+		}
+	case reflect.Slice:
+		l, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		for i, e := range l {
+			unknownFields(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+		for _, item := range m {
+			unknownFields(item.Value, t.Elem(), path+"."+fmt.Sprint(item.Key), errs)
+		}
 	}
 }
 
-func (c *Config) mustLoadEndorserConfig() {
+// loadNodes loads the endorsers, committers and orderers
+func (c *Config) loadNodes(errs *validationError) {
 	for i := range c.Endorsers {
-		c.Endorsers[i].mustLoadConfig()
+		errs.add(fmt.Sprintf("endorsers[%d]", i), c.loadNodeConfig(&c.Endorsers[i]))
 	}
 	c.EndorserNum = len(c.Endorsers)
-}
 
-func (c *Config) mustLoadCommiterConfig() {
-	c.Committer.mustLoadConfig()
-}
+	// Neither the committer nor the orderer is needed in query mode
+	if len(c.Committers) == 0 {
+		c.Committers = []Node{c.Committer}
+		if c.Committer.Address != "" || !c.Query {
+			errs.add("committer", c.loadNodeConfig(&c.Committers[0]))
+		}
+	} else {
+		for i := range c.Committers {
+			errs.add(fmt.Sprintf("committers[%d]", i), c.loadNodeConfig(&c.Committers[i]))
+		}
+	}
 
-func (c *Config) mustLoadOrdererConfig() {
-	c.Orderer.mustLoadConfig()
+	if len(c.Orderers) == 0 {
+		c.Orderers = []Node{c.Orderer}
+		if c.Orderer.Address != "" || !c.Query {
+			errs.add("orderer", c.loadNodeConfig(&c.Orderers[0]))
+		}
+	} else {
+		for i := range c.Orderers {
+			errs.add(fmt.Sprintf("orderers[%d]", i), c.loadNodeConfig(&c.Orderers[i]))
+		}
+	}
 }
 
-func (c *Config) mustValid() {
+// valid checks the loaded config and fills in the defaults
+func (c *Config) valid(errs *validationError) {
 	if c.Rate < 0 {
-		logger.Panicf("Rate %f is not a zero (unlimited) or positive number\n", c.Rate)
+		errs.addf("rate", "%d is not a zero (unlimited) or positive number", c.Rate)
 	}
 
 	if c.Burst < 1 {
-		logger.Panicf("Burst %d is not greater than 1\n", c.Burst)
+		errs.addf("burst", "%d is less than 1", c.Burst)
+	}
+
+	if c.TxNum < 1 {
+		errs.addf("txNum", "%d is not positive", c.TxNum)
+	}
+
+	// Each of the stages below hangs the pipeline if it has no worker
+	if c.ConnNum < 1 {
+		errs.addf("connNum", "%d is not positive", c.ConnNum)
+	}
+
+	if c.ClientPerConnNum < 1 {
+		errs.addf("clientPerConnNum", "%d is not positive", c.ClientPerConnNum)
+	}
+
+	if c.SignerNum < 1 {
+		errs.addf("signerNum", "%d is not positive", c.SignerNum)
+	}
+
+	if c.IntegratorNum < 1 {
+		errs.addf("integratorNum", "%d is not positive", c.IntegratorNum)
+	}
+
+	if c.BroadcasterNum < 1 && !c.Query {
+		errs.addf("broadcasterNum", "%d is not positive", c.BroadcasterNum)
+	}
+
+	if c.MSPID == "" {
+		errs.addf("mspid", "not provided")
+	}
+
+	if c.EndorserNum == 0 {
+		errs.addf("endorsers", "no endorser is provided")
+	}
+
+	if c.EndorserGroupNum == 0 {
+		c.EndorserGroupNum = 1
+	}
+
+	if c.EndorserGroupNum < 0 || c.EndorserNum%c.EndorserGroupNum != 0 {
+		errs.addf("endorserGroupNum", "%d endorsers cannot be divided into %d groups", c.EndorserNum, c.EndorserGroupNum)
+	} else {
+		c.EndorsersPerGroup = c.EndorserNum / c.EndorserGroupNum
+	}
+
+	if c.Timeout.Endorse < 0 || c.Timeout.Broadcast < 0 || c.Timeout.Hedge < 0 {
+		errs.addf("timeout", "endorse %d, broadcast %d and hedge %d must not be negative", c.Timeout.Endorse, c.Timeout.Broadcast, c.Timeout.Hedge)
+	}
+
+	for i := range c.Targets {
+		// The only target is made of the top-level fields if 'targets' is not provided
+		prefix := fmt.Sprintf("targets[%d].", i)
+		if c.implicitTarget {
+			prefix = ""
+		}
+		c.Targets[i].valid(prefix, errs)
+	}
+
+	for i := range c.RateProfile {
+		errs.add(fmt.Sprintf("rateProfile[%d]", i), c.RateProfile[i].valid())
+	}
+
+	if c.ClosedLoop.Clients < 0 || c.ClosedLoop.ThinkTime < 0 {
+		errs.addf("closedLoop", "clients %d and think time %d must not be negative", c.ClosedLoop.Clients, c.ClosedLoop.ThinkTime)
+	}
+
+	c.Search.valid(errs)
+
+	switch c.ClosedLoop.WaitFor {
+	case "":
+		c.ClosedLoop.WaitFor = "commit"
+	case "commit", "endorsement":
+	default:
+		errs.addf("closedLoop.waitFor", "closed-loop clients can only wait for commit or endorsement, not %q", c.ClosedLoop.WaitFor)
+	}
+
+	if c.CommitQuorum < 0 || c.CommitQuorum > len(c.Committers) {
+		errs.addf("commitQuorum", "%d is out of range [0, %d]", c.CommitQuorum, len(c.Committers))
+	}
+
+	if c.CommitQuorum == 0 {
+		c.CommitQuorum = len(c.Committers)
+	}
+
+	switch c.OrdererPolicy {
+	case "":
+		c.OrdererPolicy = "roundRobin"
+	case "roundRobin", "leader", "random":
+	default:
+		errs.addf("ordererPolicy", "unknown orderer policy %q", c.OrdererPolicy)
+	}
+
+	switch c.BroadcastRetry.Policy {
+	case "":
+		c.BroadcastRetry.Policy = "reject"
+	case "reject", "resend":
+	default:
+		errs.addf("broadcastRetry.policy", "unknown broadcast retry policy %q", c.BroadcastRetry.Policy)
+	}
+
+	if c.BroadcastRetry.MaxAttempts < 0 {
+		errs.addf("broadcastRetry.maxAttempts", "%d must not be negative", c.BroadcastRetry.MaxAttempts)
+	}
+
+	if c.BroadcastRetry.MaxAttempts == 0 {
+		c.BroadcastRetry.MaxAttempts = 3
+	}
+
+	if c.ObserverTimeout < 0 {
+		errs.addf("observerTimeout", "%d must not be negative", c.ObserverTimeout)
+	}
+
+	if c.ObserverTimeout == 0 {
+		c.ObserverTimeout = 20
+	}
+
+	switch c.Completion {
+	case "":
+		c.Completion = "broadcast"
+	case "broadcast", "submitted":
+	case "percentage":
+		if c.CompletionPercent <= 0 || c.CompletionPercent > 100 {
+			errs.addf("completionPercent", "%f is out of range (0, 100]", c.CompletionPercent)
+		}
+	default:
+		errs.addf("completion", "unknown completion mode %q", c.Completion)
+	}
+
+	switch c.DeliverMode {
+	case "":
+		c.DeliverMode = "filtered"
+	case "filtered", "full", "private":
+	default:
+		errs.addf("deliverMode", "unknown deliver mode %q", c.DeliverMode)
+	}
+
+	if c.BatchSize.MaxMessageCount < 0 || c.BatchSize.PreferredMaxBytes < 0 {
+		errs.addf("batchSize", "%d and %d bytes must not be negative", c.BatchSize.MaxMessageCount, c.BatchSize.PreferredMaxBytes)
+	}
+
+	if c.WarmUp < 0 || c.CoolDown < 0 {
+		errs.addf("warmUp", "warmUp %d and coolDown %d must not be negative", c.WarmUp, c.CoolDown)
+	}
+
+	if c.TimeSeriesPath == "" {
+		c.TimeSeriesPath = strings.TrimSuffix(c.ReportPath, filepath.Ext(c.ReportPath)) + "_timeseries.csv"
+	}
+
+	if c.RWSetPath == "" {
+		c.RWSetPath = strings.TrimSuffix(c.ReportPath, filepath.Ext(c.ReportPath)) + "_rwsets.jsonl"
+	}
+
+	if c.BlockStatsPath == "" {
+		c.BlockStatsPath = strings.TrimSuffix(c.ReportPath, filepath.Ext(c.ReportPath)) + "_blocks.csv"
+	}
+
+	if c.ConflictPath == "" {
+		c.ConflictPath = strings.TrimSuffix(c.ReportPath, filepath.Ext(c.ReportPath)) + "_conflicts.csv"
 	}
 
 	if c.Rate > c.Burst {
-		fmt.Printf("Rate %d is bigger than burst %d, so let rate equal to burst\n", c.Rate, c.Burst)
+		logger.Warnf("Rate %d is bigger than burst %d, so let rate equal to burst", c.Rate, c.Burst)
 		c.Rate = c.Burst
 	}
 }
 
-func LoadConfigFromFile(filename string) (*Config, error) {
+// LoadConfigFromFile loads the config, overridden by TAPE_ environment variables and then 'sets'
+// (see applyOverrides), and checks it. Unless the file or an override cannot be parsed,
+// every problem is reported at once, each with the path of the field, e.g. 'endorsers[1].tlsCACert'.
+func LoadConfigFromFile(filename string, sets ...string) (*Config, error) {
+	return loadConfigFromFile(filename, sets, true)
+}
+
+// ValidateConfigFromFile checks the config like LoadConfigFromFile, but without connecting to
+// any node, so the nodes which discovery would provide are not checked
+func ValidateConfigFromFile(filename string, sets ...string) (*Config, error) {
+	return loadConfigFromFile(filename, sets, false)
+}
+
+func loadConfigFromFile(filename string, sets []string, online bool) (*Config, error) {
 	c := &Config{}
 
-	c.mustLoadRawConfigFromFile(filename)
-	c.mustLoadEndorserConfig()
-	c.mustLoadCommiterConfig()
-	c.mustLoadOrdererConfig()
-	c.mustLoadClientIdentity()
+	if err := c.loadRawConfigFromFile(filename); err != nil {
+		return nil, err
+	}
+	if err := c.applyOverrides(os.Environ(), sets); err != nil {
+		return nil, err
+	}
+	c.mustLoadTargets()
+
+	errs := &validationError{}
+	errs.add("connectionProfile", c.loadConnectionProfile())
+
+	// Discovery signs its request with the client identity
+	if err := c.loadClientIdentity(); err != nil {
+		errs.add("", err)
+	} else if online {
+		errs.add("discovery", c.discover())
+	} else {
+		errs.add("discovery", c.skipDiscovery())
+	}
 
-	c.mustValid()
+	c.loadNodes(errs)
+	c.valid(errs)
 
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
-// mustLoadClientIdentity loads the client specified in the configuration file
-func (c *Config) mustLoadClientIdentity() {
+// effectiveConfig returns the config in YAML after the overrides and defaults.
+// Only the paths of certificates and keys are included, so the nodes found by discovery
+// and the certificates and identity given inline by the connection profile are not.
+func effectiveConfig() string {
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Sprintf("Fail to marshal the effective config: %v\n", err)
+	}
+	return string(out)
+}
+
+// loadClientIdentity loads the client specified in the configuration file
+func (c *Config) loadClientIdentity() error {
 	cc := CryptoConfig{
 		MSPID:    c.MSPID,
 		PrivKey:  c.PrivateKey,
 		SignCert: c.SignCert,
 	}
 
-	privateKey, err := GetPrivateKey(cc.PrivKey)
+	var privateKey *ecdsa.PrivateKey
+	var err error
+	if c.privateKeyPEM != nil {
+		privateKey, err = parsePrivateKey(c.privateKeyPEM)
+	} else {
+		privateKey, err = GetPrivateKey(cc.PrivKey)
+	}
 	if err != nil {
-		logger.Fatalf("Fail to load private key: %v", err)
+		errs := &validationError{}
+		errs.add("privateKey", err)
+		return errs
 	}
 
-	cert, certBytes, err := GetCertificate(cc.SignCert)
+	var cert *x509.Certificate
+	var certBytes []byte
+	if c.signCertPEM != nil {
+		cert, certBytes, err = parseCertificate(c.signCertPEM)
+	} else {
+		cert, certBytes, err = GetCertificate(cc.SignCert)
+	}
 	if err != nil {
-		logger.Fatalf("Fail to load certificate: %v", err)
+		errs := &validationError{}
+		errs.add("signCert", err)
+		return errs
 	}
 
 	id := &msp.SerializedIdentity{
@@ -154,7 +526,9 @@ func (c *Config) mustLoadClientIdentity() {
 	}
 	name, err := proto.Marshal(id)
 	if err != nil {
-		logger.Fatalf("Fail to get msp id: %v", err)
+		errs := &validationError{}
+		errs.add("mspid", err)
+		return errs
 	}
 
 	c.Identity = &Crypto{
@@ -162,6 +536,7 @@ func (c *Config) mustLoadClientIdentity() {
 		PrivKey:  privateKey,
 		SignCert: cert,
 	}
+	return nil
 }
 
 func GetTLSCACerts(file string) ([]byte, error) {
@@ -177,24 +552,109 @@ func GetTLSCACerts(file string) ([]byte, error) {
 	return in, nil
 }
 
-//TODO
-func (n *Node) mustLoadConfig() {
+// loadNodeConfig fills the client TLS certificate and key of the node which are not provided
+// from the config, and loads the node
+func (c *Config) loadNodeConfig(n *Node) error {
+	if n.TLSCAKey != "" || n.TLSCARoot != "" {
+		// A key without its certificate cannot be used for mutual TLS, so the deprecated fields are not mapped
+		logger.Warnf("tlsCAKey and tlsCARoot of %s are deprecated and ignored, use tlsClientCert and tlsClientKey instead", n.Address)
+	}
+
+	if n.TLSClientCert == "" && n.TLSClientKey == "" {
+		n.TLSClientCert = c.TLSClientCert
+		n.TLSClientKey = c.TLSClientKey
+	}
+
+	return n.loadConfig()
+}
+
+// loadConfig reads the TLS certificates and keys of the node
+func (n *Node) loadConfig() error {
+	errs := &validationError{}
+
+	if n.Address == "" {
+		errs.addf("address", "not provided")
+	}
+
+	errs.add("grpc", n.GRPC.valid())
+
 	certByte, err := GetTLSCACerts(n.TLSCACert)
 	if err != nil && err != itemNotProvidedError {
-		logger.Fatalf("Fail to load TLS CA Cert %s: %v", n.TLSCACert, err)
+		errs.add("tlsCACert", err)
 	}
 
-	keyByte, err := GetTLSCACerts(n.TLSCAKey)
-	if err != nil && err != itemNotProvidedError {
-		logger.Fatalf("Fail to load TLS CA Key %s: %v", n.TLSCAKey, err)
+	// The TLS CA Cert of a discovered node is provided without a file
+	if certByte != nil {
+		n.TLSCACertByte = certByte
 	}
 
-	rootByte, err := GetTLSCACerts(n.TLSCARoot)
-	if err != nil && err != itemNotProvidedError {
-		logger.Fatalf("Fail to load TLS CA Root %s: %v", n.TLSCARoot, err)
+	if n.GRPC.VerifyTLS && n.TLSCACert == "" && n.TLSCACertByte == nil {
+		errs.addf("grpc.verifyTLS", "tlsCACert must be provided to verify the certificate of the node")
+	}
+
+	if (n.TLSClientCert == "") != (n.TLSClientKey == "") {
+		errs.addf("tlsClientKey", "both client TLS cert and key must be provided for mutual TLS, got cert %q and key %q", n.TLSClientCert, n.TLSClientKey)
+		return errs.err()
+	}
+	if n.TLSClientCert == "" {
+		return errs.err()
+	}
+
+	clientCertByte, certErr := ioutil.ReadFile(n.TLSClientCert)
+	errs.add("tlsClientCert", certErr)
+
+	clientKeyByte, keyErr := ioutil.ReadFile(n.TLSClientKey)
+	errs.add("tlsClientKey", keyErr)
+
+	if certErr != nil || keyErr != nil {
+		return errs.err()
 	}
 
-	n.TLSCACertByte = certByte
-	n.TLSCAKeyByte = keyByte
-	n.TLSCARootByte = rootByte
+	if _, err = tls.X509KeyPair(clientCertByte, clientKeyByte); err != nil {
+		errs.add("tlsClientKey", errors.Wrapf(err, "does not match client TLS cert %s", n.TLSClientCert))
+		return errs.err()
+	}
+
+	n.TLSClientCertByte = clientCertByte
+	n.TLSClientKeyByte = clientKeyByte
+	return errs.err()
+}
+
+// validationError lists every problem found in the config, each starting with the path of the field
+type validationError struct {
+	problems []string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("%d problem(s) in the config:\n  %s", len(e.problems), strings.Join(e.problems, "\n  "))
+}
+
+// add records 'err' of the field at 'path' if it is not nil.
+// The problems of a nested validationError, e.g. of a node, are recorded under 'path'.
+func (e *validationError) add(path string, err error) {
+	if err == nil {
+		return
+	}
+	if nested, ok := err.(*validationError); ok {
+		for _, p := range nested.problems {
+			if path != "" {
+				p = path + "." + p
+			}
+			e.problems = append(e.problems, p)
+		}
+		return
+	}
+	e.problems = append(e.problems, path+": "+err.Error())
+}
+
+func (e *validationError) addf(path string, format string, args ...interface{}) {
+	e.problems = append(e.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// err returns nil if there is no problem
+func (e *validationError) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return e
 }
@@ -0,0 +1,227 @@
+package infra
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidationErrorAdd(t *testing.T) {
+	nested := &validationError{problems: []string{"address: empty", "grpc.dialTimeout: negative"}}
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+		want []string
+	}{
+		{"no error", "endorsers[0]", nil, nil},
+		{"plain error", "rate", errors.New("negative"), []string{"rate: negative"}},
+		{"nested problems", "endorsers[0]", nested, []string{"endorsers[0].address: empty", "endorsers[0].grpc.dialTimeout: negative"}},
+		{"nested problems at the top", "", nested, []string{"address: empty", "grpc.dialTimeout: negative"}},
+		{"nested without problems", "endorsers[0]", &validationError{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := &validationError{}
+			errs.add(tt.path, tt.err)
+			if !reflect.DeepEqual(errs.problems, tt.want) {
+				t.Errorf("problems = %q, want %q", errs.problems, tt.want)
+			}
+			if (errs.err() == nil) != (len(tt.want) == 0) {
+				t.Errorf("err() = %v with %d problem(s)", errs.err(), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestLoadRawConfigFromFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		problems []string // a part of each problem in order, empty if valid
+		wantErr  bool     // the file cannot be parsed at all
+	}{
+		{
+			name: "node definition with an anchor",
+			yaml: "peer1: &peer1\n  address: peer1:7051\nendorsers:\n  - *peer1\nchannel: mychannel\n",
+		},
+		{
+			name: "quoted node definition",
+			yaml: "\"peer1\": &peer1\n  address: peer1:7051\n'peer2': &peer2\n  address: peer2:7051\nendorsers:\n  - *peer1\n  - *peer2\n",
+		},
+		{
+			name:     "unknown top-level key",
+			yaml:     "channel: mychannel\nchanel: mychannel\n",
+			problems: []string{"chanel: unknown field, or a top-level node definition without an anchor"},
+		},
+		{
+			name:     "unknown field of a node",
+			yaml:     "endorsers:\n  - address: peer1:7051\n  - addr: peer2:7051\n",
+			problems: []string{"endorsers[1].addr: unknown field"},
+		},
+		{
+			name:     "unknown field of an aliased node",
+			yaml:     "peer1: &peer1\n  addr: peer1:7051\nendorsers:\n  - *peer1\ncommitter: *peer1\n",
+			problems: []string{"endorsers[0].addr: unknown field", "committer.addr: unknown field"},
+		},
+		{
+			name:     "unknown field in the gRPC options",
+			yaml:     "orderer:\n  address: orderer:7050\n  grpc:\n    timeout: 100\n",
+			problems: []string{"orderer.grpc.timeout: unknown field"},
+		},
+		{
+			name:     "type error is kept",
+			yaml:     "txNum: many\n",
+			problems: []string{"cannot unmarshal !!str `many` into int"},
+		},
+		{
+			name:    "invalid YAML",
+			yaml:    "channel: [mychannel\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			if err := ioutil.WriteFile(filename, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c := &Config{}
+			err := c.loadRawConfigFromFile(filename)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadRawConfigFromFile() succeeds, want an error")
+				}
+				if _, ok := err.(*validationError); ok {
+					t.Errorf("loadRawConfigFromFile() = %v, want an unmarshal error", err)
+				}
+				return
+			}
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("loadRawConfigFromFile() = %v, want no error", err)
+				}
+				return
+			}
+
+			errs, ok := err.(*validationError)
+			if !ok {
+				t.Fatalf("loadRawConfigFromFile() = %v, want the problems %q", err, tt.problems)
+			}
+			if len(errs.problems) != len(tt.problems) {
+				t.Fatalf("problems = %q, want %q", errs.problems, tt.problems)
+			}
+			for j, problem := range tt.problems {
+				if !strings.Contains(errs.problems[j], problem) {
+					t.Errorf("problem %d = %q, want %q", j, errs.problems[j], problem)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadNodeConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatalf("Fail to write %s: %v", path, err)
+		}
+		return path
+	}
+	defaultCert, defaultKey := selfSignedPair(t, "client")
+	nodeCert, nodeKey := selfSignedPair(t, "peer0")
+	_, otherKey := selfSignedPair(t, "peer0")
+	c := &Config{TLSClientCert: write("client.crt", defaultCert), TLSClientKey: write("client.key", defaultKey)}
+	nodeCertFile, nodeKeyFile := write("peer0.crt", nodeCert), write("peer0.key", nodeKey)
+	otherKeyFile := write("other.key", otherKey)
+
+	tests := []struct {
+		name     string
+		node     Node
+		wantCert []byte
+		problem  string // a part of the problem, empty if the node is loaded
+	}{
+		{"client pair of the config", Node{Address: "peer0:7051"}, defaultCert, ""},
+		{"client pair of the node", Node{Address: "peer0:7051", TLSClientCert: nodeCertFile, TLSClientKey: nodeKeyFile}, nodeCert, ""},
+		{"deprecated tlsCAKey is ignored", Node{Address: "peer0:7051", TLSCAKey: nodeKeyFile}, defaultCert, ""},
+		{"cert without key", Node{Address: "peer0:7051", TLSClientCert: nodeCertFile}, nil, "tlsClientKey: both client TLS cert and key"},
+		{"mismatched pair", Node{Address: "peer0:7051", TLSClientCert: nodeCertFile, TLSClientKey: otherKeyFile}, nil, "tlsClientKey: does not match"},
+		{"missing key file", Node{Address: "peer0:7051", TLSClientCert: nodeCertFile, TLSClientKey: filepath.Join(dir, "missing.key")}, nil, "tlsClientKey: open"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := tt.node
+			err := c.loadNodeConfig(&n)
+			if tt.problem != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.problem) {
+					t.Errorf("loadNodeConfig() = %v, want the problem %q", err, tt.problem)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadNodeConfig() = %v, want no error", err)
+			}
+			if !bytes.Equal(n.TLSClientCertByte, tt.wantCert) {
+				t.Errorf("node is loaded with another client TLS cert")
+			}
+			if n.TLSClientKeyByte == nil {
+				t.Errorf("client TLS key is not loaded")
+			}
+		})
+	}
+}
+
+func TestValidateConfigFromFile(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := selfSignedPair(t, "User1")
+	for name, content := range map[string][]byte{"cert.pem": cert, "key.pem": key} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing listens on the bootstrap peer, which validation must not connect to
+	common := "channel: mychannel\nchaincode: basic\ntxType: put\nmspid: Org1MSP\n" +
+		"privateKey: " + filepath.Join(dir, "key.pem") + "\nsignCert: " + filepath.Join(dir, "cert.pem") + "\n" +
+		"txNum: 10\nburst: 10\nconnNum: 1\nclientPerConnNum: 1\nsignerNum: 1\nintegratorNum: 1\nbroadcasterNum: 1\n"
+	tests := []struct {
+		name    string
+		yaml    string
+		problem string // a part of the problem, empty if valid
+	}{
+		{"discovery", common + "discovery:\n  peer:\n    address: 127.0.0.1:1\n", ""},
+		{"discovery with an orderer", common + "orderer:\n  address: orderer:7050\ndiscovery:\n  peer:\n    address: 127.0.0.1:1\n", ""},
+		{"invalid bootstrap peer", common + "discovery:\n  peer:\n    address: 127.0.0.1:1\n    grpc:\n      dialTimeout: -1\n", "discovery.peer.grpc"},
+		{"no discovery nor endorsers", common + "orderer:\n  address: orderer:7050\ncommitter:\n  address: peer0:7051\n", "endorsers: no endorser"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.yaml")
+			if err := ioutil.WriteFile(filename, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := ValidateConfigFromFile(filename)
+			if tt.problem == "" {
+				if err != nil {
+					t.Errorf("ValidateConfigFromFile() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.problem) {
+				t.Errorf("ValidateConfigFromFile() = %v, want the problem %q", err, tt.problem)
+			}
+		})
+	}
+}
@@ -150,6 +150,10 @@ func GetPrivateKey(f string) (*ecdsa.PrivateKey, error) {
 		return nil, err
 	}
 
+	return parsePrivateKey(in)
+}
+
+func parsePrivateKey(in []byte) (*ecdsa.PrivateKey, error) {
 	k, err := PEMtoPrivateKey(in, []byte{})
 	if err != nil {
 		return nil, err
@@ -169,7 +173,14 @@ func GetCertificate(f string) (*x509.Certificate, []byte, error) {
 		return nil, nil, err
 	}
 
+	return parseCertificate(in)
+}
+
+func parseCertificate(in []byte) (*x509.Certificate, []byte, error) {
 	block, _ := pem.Decode(in)
+	if block == nil {
+		return nil, nil, errors.New("no PEM block in certificate")
+	}
 
 	c, err := x509.ParseCertificate(block.Bytes)
 	return c, in, err
@@ -0,0 +1,314 @@
+package infra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GwanWingYan/fabric-protos-go/discovery"
+	"github.com/GwanWingYan/fabric-protos-go/gossip"
+	"github.com/GwanWingYan/fabric-protos-go/msp"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDiscoveryTimeout = 10 * time.Second
+)
+
+// DiscoveryConfig queries the discovery service of a bootstrap peer for the endorsers, the orderers
+// and their TLS CA certs, so that only one peer has to be listed in the config
+type DiscoveryConfig struct {
+	Peer        Node `yaml:"peer"`        // the bootstrap peer, discovery is disabled if its address is empty
+	AsLocalhost bool `yaml:"asLocalhost"` // connect to discovered nodes on localhost, e.g. for a network in docker
+	Timeout     int  `yaml:"timeout"`     // milliseconds to wait for the answer, 10000 by default
+}
+
+func (d *DiscoveryConfig) enabled() bool {
+	return d.Peer.Address != ""
+}
+
+// discoveredPeer is an endorser in the endorsement descriptor
+type discoveredPeer struct {
+	endpoint string
+	mspid    string
+}
+
+// discover replaces the endorsers with the ones discovered for the chaincode of the first target,
+// arranged in groups each of which satisfies the endorsement policy.
+// The orderers and the committer are also taken from discovery if they are not provided.
+func (c *Config) discover() error {
+	if !c.Discovery.enabled() {
+		return nil
+	}
+
+	if err := c.loadNodeConfig(&c.Discovery.Peer); err != nil {
+		errs := &validationError{}
+		errs.add("peer", err)
+		return errs
+	}
+	bootstrap := c.Discovery.Peer
+	target := c.Targets[0]
+
+	configResult, descriptor, err := c.queryDiscovery(target)
+	if err != nil {
+		return errors.WithMessagef(err, "fail to query the discovery service of %s", bootstrap.Address)
+	}
+
+	groups, err := endorserGroups(descriptor)
+	if err != nil {
+		return errors.WithMessagef(err, "fail to arrange endorsers of %s on channel %s", target.Chaincode, target.Channel)
+	}
+
+	if len(c.Endorsers) > 0 {
+		logger.Warnf("Endorsers in the config are replaced by the discovered ones")
+	}
+	c.Endorsers = nil
+	for _, group := range groups {
+		for _, p := range group {
+			node, err := c.discoveredNode(p.endpoint, p.mspid, configResult)
+			if err != nil {
+				return err
+			}
+			c.Endorsers = append(c.Endorsers, node)
+		}
+	}
+	c.EndorserGroupNum = len(groups)
+	logger.Infof("Discover %d endorsers in %d groups of %d for %s on channel %s", len(c.Endorsers), len(groups), len(groups[0]), target.Chaincode, target.Channel)
+
+	if len(c.Orderers) == 0 && c.Orderer.Address == "" {
+		var mspids []string
+		for mspid := range configResult.Orderers {
+			mspids = append(mspids, mspid)
+		}
+		sort.Strings(mspids)
+
+		for _, mspid := range mspids {
+			for _, endpoint := range configResult.Orderers[mspid].Endpoint {
+				address := net.JoinHostPort(endpoint.Host, strconv.Itoa(int(endpoint.Port)))
+				node, err := c.discoveredNode(address, mspid, configResult)
+				if err != nil {
+					return err
+				}
+				c.Orderers = append(c.Orderers, node)
+			}
+		}
+		if len(c.Orderers) == 0 {
+			return errors.Errorf("no orderer is discovered on channel %s", target.Channel)
+		}
+		logger.Infof("Discover %d orderers on channel %s", len(c.Orderers), target.Channel)
+	}
+
+	if len(c.Committers) == 0 && c.Committer.Address == "" {
+		c.Committer = bootstrap
+	}
+
+	return nil
+}
+
+// skipDiscovery checks the bootstrap peer without querying it, and puts it in place of the endorsers,
+// and of the orderer and the committer if they are not provided, so that the rest of the config
+// can be checked without connecting to any node
+func (c *Config) skipDiscovery() error {
+	if !c.Discovery.enabled() {
+		return nil
+	}
+
+	if err := c.loadNodeConfig(&c.Discovery.Peer); err != nil {
+		errs := &validationError{}
+		errs.add("peer", err)
+		return errs
+	}
+	bootstrap := c.Discovery.Peer
+
+	c.Endorsers = []Node{bootstrap}
+	c.EndorserGroupNum = 1
+	if len(c.Orderers) == 0 && c.Orderer.Address == "" {
+		c.Orderer = bootstrap
+	}
+	if len(c.Committers) == 0 && c.Committer.Address == "" {
+		c.Committer = bootstrap
+	}
+	return nil
+}
+
+// queryDiscovery asks the bootstrap peer for the channel config and the endorsement descriptor of the target
+func (c *Config) queryDiscovery(target Target) (*discovery.ConfigResult, *discovery.EndorsementDescriptor, error) {
+	bootstrap := c.Discovery.Peer
+
+	auth := &discovery.AuthInfo{ClientIdentity: c.Identity.Creator}
+	if bootstrap.TLSClientCertByte != nil {
+		// A peer with mutual TLS requires the hash of the client TLS cert
+		if block, _ := pem.Decode(bootstrap.TLSClientCertByte); block != nil {
+			hash := sha256.Sum256(block.Bytes)
+			auth.ClientTlsCertHash = hash[:]
+		}
+	}
+
+	request := &discovery.Request{
+		Authentication: auth,
+		Queries: []*discovery.Query{
+			{
+				Channel: target.Channel,
+				Query:   &discovery.Query_ConfigQuery{ConfigQuery: &discovery.ConfigQuery{}},
+			},
+			{
+				Channel: target.Channel,
+				Query: &discovery.Query_CcQuery{CcQuery: &discovery.ChaincodeQuery{
+					Interests: []*peer.ChaincodeInterest{{Chaincodes: []*peer.ChaincodeCall{{Name: target.Chaincode}}}},
+				}},
+			},
+		},
+	}
+	payload, err := proto.Marshal(request)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fail to marshal discovery request")
+	}
+	signature, err := c.Identity.Sign(payload)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fail to sign discovery request")
+	}
+
+	conn, err := DialConnection(bootstrap)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	timeout := defaultDiscoveryTimeout
+	if c.Discovery.Timeout > 0 {
+		timeout = time.Duration(c.Discovery.Timeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	response, err := discovery.NewDiscoveryClient(conn).Discover(ctx, &discovery.SignedRequest{Payload: payload, Signature: signature})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fail to discover")
+	}
+	if len(response.Results) != len(request.Queries) {
+		return nil, nil, errors.Errorf("%d results for %d queries", len(response.Results), len(request.Queries))
+	}
+	for _, result := range response.Results {
+		if e := result.GetError(); e != nil {
+			return nil, nil, errors.New(e.Content)
+		}
+	}
+
+	configResult := response.Results[0].GetConfigResult()
+	ccResult := response.Results[1].GetCcQueryRes()
+	if configResult == nil || ccResult == nil || len(ccResult.Content) == 0 {
+		return nil, nil, errors.New("incomplete discovery response")
+	}
+	return configResult, ccResult.Content[0], nil
+}
+
+// endorserGroups arranges the endorsers into disjoint groups of the same layout, each of which
+// satisfies the endorsement policy. The layout giving the most groups is chosen,
+// and then the one needing the fewest endorsers per group.
+func endorserGroups(descriptor *discovery.EndorsementDescriptor) ([][]*discoveredPeer, error) {
+	peersByGroup := make(map[string][]*discoveredPeer)
+	for name, peers := range descriptor.EndorsersByGroups {
+		for _, p := range peers.Peers {
+			dp, err := parseDiscoveredPeer(p)
+			if err != nil {
+				return nil, err
+			}
+			peersByGroup[name] = append(peersByGroup[name], dp)
+		}
+		sort.Slice(peersByGroup[name], func(i, j int) bool {
+			return peersByGroup[name][i].endpoint < peersByGroup[name][j].endpoint
+		})
+	}
+
+	var best *discovery.Layout
+	bestGroups, bestSize := 0, 0
+	for _, layout := range descriptor.Layouts {
+		groups, size := -1, 0
+		for name, quantity := range layout.QuantitiesByGroup {
+			if n := len(peersByGroup[name]) / int(quantity); groups < 0 || n < groups {
+				groups = n
+			}
+			size += int(quantity)
+		}
+		if groups > bestGroups || groups == bestGroups && groups > 0 && size < bestSize {
+			best, bestGroups, bestSize = layout, groups, size
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no layout can be satisfied by the discovered endorsers")
+	}
+
+	names := make([]string, 0, len(best.QuantitiesByGroup))
+	for name := range best.QuantitiesByGroup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := make([][]*discoveredPeer, bestGroups)
+	for k := range groups {
+		for _, name := range names {
+			quantity := int(best.QuantitiesByGroup[name])
+			groups[k] = append(groups[k], peersByGroup[name][k*quantity:(k+1)*quantity]...)
+		}
+	}
+	return groups, nil
+}
+
+// parseDiscoveredPeer extracts the endpoint and the MSP of a peer
+func parseDiscoveredPeer(p *discovery.Peer) (*discoveredPeer, error) {
+	if p.MembershipInfo == nil {
+		return nil, errors.New("discovered peer without membership info")
+	}
+	message := &gossip.GossipMessage{}
+	if err := proto.Unmarshal(p.MembershipInfo.Payload, message); err != nil {
+		return nil, errors.Wrap(err, "fail to unmarshal membership info")
+	}
+	alive := message.GetAliveMsg()
+	if alive == nil || alive.Membership == nil || alive.Membership.Endpoint == "" {
+		return nil, errors.New("discovered peer without endpoint")
+	}
+
+	identity := &msp.SerializedIdentity{}
+	if err := proto.Unmarshal(p.Identity, identity); err != nil {
+		return nil, errors.Wrap(err, "fail to unmarshal peer identity")
+	}
+
+	return &discoveredPeer{endpoint: alive.Membership.Endpoint, mspid: identity.Mspid}, nil
+}
+
+// discoveredNode creates a node trusting the TLS CA certs of its MSP,
+// with the gRPC options, except the server name, and client TLS cert and key of the bootstrap peer
+func (c *Config) discoveredNode(address string, mspid string, configResult *discovery.ConfigResult) (Node, error) {
+	node := Node{
+		Address:       address,
+		TLSClientCert: c.Discovery.Peer.TLSClientCert,
+		TLSClientKey:  c.Discovery.Peer.TLSClientKey,
+		Org:           mspid,
+		GRPC:          c.Discovery.Peer.GRPC,
+	}
+	// The server name of the bootstrap peer does not match the certificate of another node
+	node.GRPC.ServerNameOverride = ""
+
+	if mspConfig, ok := configResult.Msps[mspid]; ok {
+		for _, cert := range append(mspConfig.TlsRootCerts, mspConfig.TlsIntermediateCerts...) {
+			node.TLSCACertByte = append(node.TLSCACertByte, cert...)
+		}
+	}
+
+	if c.Discovery.AsLocalhost {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return node, errors.Wrapf(err, "invalid discovered address %s", address)
+		}
+		node.Address = net.JoinHostPort("localhost", port)
+		node.GRPC.ServerNameOverride = host
+	}
+
+	return node, nil
+}
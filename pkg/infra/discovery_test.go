@@ -0,0 +1,151 @@
+package infra
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GwanWingYan/HLF-2.2/protoutil"
+	"github.com/GwanWingYan/fabric-protos-go/discovery"
+	"github.com/GwanWingYan/fabric-protos-go/gossip"
+	"github.com/GwanWingYan/fabric-protos-go/msp"
+)
+
+// peersOf builds the discovered peers of an MSP with only their endpoints and identities
+func peersOf(mspid string, endpoints ...string) *discovery.Peers {
+	peers := &discovery.Peers{}
+	for _, endpoint := range endpoints {
+		peers.Peers = append(peers.Peers, &discovery.Peer{
+			MembershipInfo: &gossip.Envelope{
+				Payload: protoutil.MarshalOrPanic(&gossip.GossipMessage{
+					Content: &gossip.GossipMessage_AliveMsg{
+						AliveMsg: &gossip.AliveMessage{Membership: &gossip.Member{Endpoint: endpoint}},
+					},
+				}),
+			},
+			Identity: protoutil.MarshalOrPanic(&msp.SerializedIdentity{Mspid: mspid}),
+		})
+	}
+	return peers
+}
+
+func TestEndorserGroups(t *testing.T) {
+	tests := []struct {
+		name      string
+		endorsers map[string]*discovery.Peers
+		layouts   []map[string]uint32
+		want      [][]string // endpoints of each group
+		wantErr   bool
+	}{
+		{
+			name:      "one endorser each",
+			endorsers: map[string]*discovery.Peers{"G0": peersOf("Org1MSP", "peer1:7051", "peer0:7051")},
+			layouts:   []map[string]uint32{{"G0": 1}},
+			want:      [][]string{{"peer0:7051"}, {"peer1:7051"}},
+		},
+		{
+			name: "one endorser of each organization",
+			endorsers: map[string]*discovery.Peers{
+				"G0": peersOf("Org1MSP", "peer0.org1:7051", "peer1.org1:7051"),
+				"G1": peersOf("Org2MSP", "peer0.org2:9051", "peer1.org2:9051", "peer2.org2:9051"),
+			},
+			layouts: []map[string]uint32{{"G0": 1, "G1": 1}},
+			want:    [][]string{{"peer0.org1:7051", "peer0.org2:9051"}, {"peer1.org1:7051", "peer1.org2:9051"}},
+		},
+		{
+			name: "layout with the most groups",
+			endorsers: map[string]*discovery.Peers{
+				"G0": peersOf("Org1MSP", "peer0.org1:7051"),
+				"G1": peersOf("Org2MSP", "peer0.org2:9051", "peer1.org2:9051"),
+			},
+			layouts: []map[string]uint32{{"G0": 1, "G1": 1}, {"G1": 1}},
+			want:    [][]string{{"peer0.org2:9051"}, {"peer1.org2:9051"}},
+		},
+		{
+			name: "layout with the fewest endorsers",
+			endorsers: map[string]*discovery.Peers{
+				"G0": peersOf("Org1MSP", "peer0.org1:7051"),
+				"G1": peersOf("Org2MSP", "peer0.org2:9051"),
+			},
+			layouts: []map[string]uint32{{"G0": 1, "G1": 1}, {"G0": 1}},
+			want:    [][]string{{"peer0.org1:7051"}},
+		},
+		{
+			name:      "no layout is satisfied",
+			endorsers: map[string]*discovery.Peers{"G0": peersOf("Org1MSP", "peer0:7051")},
+			layouts:   []map[string]uint32{{"G0": 2}},
+			wantErr:   true,
+		},
+		{
+			name:      "peer without membership info",
+			endorsers: map[string]*discovery.Peers{"G0": {Peers: []*discovery.Peer{{}}}},
+			layouts:   []map[string]uint32{{"G0": 1}},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			descriptor := &discovery.EndorsementDescriptor{EndorsersByGroups: tt.endorsers}
+			for _, quantities := range tt.layouts {
+				descriptor.Layouts = append(descriptor.Layouts, &discovery.Layout{QuantitiesByGroup: quantities})
+			}
+
+			groups, err := endorserGroups(descriptor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("endorserGroups() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got [][]string
+			for _, group := range groups {
+				var endpoints []string
+				for _, p := range group {
+					endpoints = append(endpoints, p.endpoint)
+				}
+				got = append(got, endpoints)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("endorserGroups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveredNode(t *testing.T) {
+	bootstrap := Node{Address: "localhost:7051", GRPC: GRPCOptions{DialTimeout: 300, ServerNameOverride: "peer0.org1.example.com"}}
+	configResult := &discovery.ConfigResult{Msps: map[string]*msp.FabricMSPConfig{
+		"Org2MSP": {TlsRootCerts: [][]byte{[]byte("root")}, TlsIntermediateCerts: [][]byte{[]byte("intermediate")}},
+	}}
+
+	tests := []struct {
+		name           string
+		asLocalhost    bool
+		wantAddress    string
+		wantServerName string
+	}{
+		{"as it is", false, "peer1.org2.example.com:9051", ""},
+		{"as localhost", true, "localhost:9051", "peer1.org2.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Discovery: DiscoveryConfig{Peer: bootstrap, AsLocalhost: tt.asLocalhost}}
+			node, err := c.discoveredNode("peer1.org2.example.com:9051", "Org2MSP", configResult)
+			if err != nil {
+				t.Fatalf("discoveredNode() error = %v", err)
+			}
+			if node.Address != tt.wantAddress {
+				t.Errorf("Address = %s, want %s", node.Address, tt.wantAddress)
+			}
+			// The server name of the bootstrap peer is never used for another node
+			if node.GRPC.ServerNameOverride != tt.wantServerName {
+				t.Errorf("ServerNameOverride = %q, want %q", node.GRPC.ServerNameOverride, tt.wantServerName)
+			}
+			if node.GRPC.DialTimeout != 300 {
+				t.Errorf("DialTimeout = %d, want 300 of the bootstrap peer", node.GRPC.DialTimeout)
+			}
+			if string(node.TLSCACertByte) != "rootintermediate" {
+				t.Errorf("TLSCACertByte = %q, want the root and intermediate certs of Org2MSP", node.TLSCACertByte)
+			}
+		})
+	}
+}
@@ -15,4 +15,7 @@ type Element struct {
 	lock           sync.Mutex
 	Envelope       *common.Envelope
 	Txid           string
+	attempts       int   // number of times the envelope is sent to the orderer, protected by lock
+	sentTime       int64 // unix nano when the envelope is sent to the orderer last time, protected by lock
+	broadcast      bool  // true once the envelope is handed to a stream to the orderer, protected by lock
 }
@@ -20,10 +20,15 @@ func NewInitiator(outCh chan *Element) *Initiator {
 	}
 
 	// Create proposal and id for all generated transactions
-	ccArgsList := generateCCArgsList()
+	ids := make(map[string]int, config.TxNum)
+	initSeed()
+	targetList := generateTargetList()
+	ccArgsList := generateCCArgsList(targetList)
+	transientList := generateTransientList(targetList)
 	session := getName(20)
 	for i := 0; i < config.TxNum; i++ {
 		ccArgs := ccArgsList[i]
+		target := config.Targets[targetList[i]]
 
 		tempTXID := ""
 		if !config.CheckTxID {
@@ -32,20 +37,25 @@ func NewInitiator(outCh chan *Element) *Initiator {
 
 		proposal, txID, err := CreateProposal(
 			tempTXID,
-			config.Channel,
-			config.Chaincode,
-			config.Version,
+			target.Channel,
+			target.Chaincode,
+			target.Version,
 			ccArgs,
+			transientList[i],
 		)
 		if err != nil {
 			logger.Fatalf("Fail to create proposal %s: %v", txID, err)
 		}
 
-		txid2id[txID] = i
+		ids[txID] = i
 		it.proposals[i] = proposal
 		it.txids[i] = txID
 	}
 
+	// Publish the mapping once every transaction of this run is created
+	txid2id = ids
+	txTargets = targetList
+
 	return it
 }
 
@@ -54,9 +64,13 @@ func generateCustomTXID(i int, session string) string {
 }
 
 // StartSync sends all unsigned transactions (raw transactions) to the channel 'raw'
-// waiting for subsequent processing
+// waiting for subsequent processing, until the run ends
 func (it *Initiator) StartSync() {
 	for i := 0; i < len(it.proposals); i++ {
-		it.outCh <- &Element{Proposal: it.proposals[i], Txid: it.txids[i]}
+		select {
+		case it.outCh <- &Element{Proposal: it.proposals[i], Txid: it.txids[i]}:
+		case <-doneCh:
+			return
+		}
 	}
 }
@@ -19,7 +19,7 @@ func NewIntegrators(inCh chan *Element, outCh chan *Element) *Integrators {
 func (its *Integrators) StartAsync() {
 	// Start multiple goroutines to extract responses and integrate it into envelope
 	for _, it := range its.integrators {
-		go it.Start()
+		goWorker(it.Start)
 	}
 }
 
@@ -33,14 +33,23 @@ func (it *Integrator) Start() {
 	for {
 		select {
 		case element := <-it.inCh:
+			// Mismatches are counted, but the transaction still goes on
+			verifyResponses(element)
+
 			// Try to generate an envelope
 			envelope, err := it.Integrate(element)
 			if err != nil {
-				// Abort directly because of the different endorsement
-				Metric.AddAbort()
+				// The endorsements differ, so the transaction never reaches the orderer.
+				// It is counted as dropped only, since aborted ones are those committed as invalid.
+				timeKeepers.keepDropped(element.Txid, "integration")
+				completeTx(element.Txid)
 				continue
 			}
-			it.outCh <- envelope
+			select {
+			case it.outCh <- envelope:
+			case <-doneCh:
+				return
+			}
 		case <-doneCh:
 			return
 		}
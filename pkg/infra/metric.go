@@ -1,13 +1,29 @@
 package infra
 
-import "sync/atomic"
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+)
 
 var (
 	Metric = NewMetricInstance()
 )
 
 type MetricInstance struct {
-	Abort int32
+	Abort     int32 // transactions aborted by integrators or invalidated by committers
+	Valid     int32 // transactions observed as valid
+	Observed  int32 // transactions observed on a quorum of committers
+	Broadcast int32 // transactions sent to the orderer
+	Dropped   int32 // transactions which never reach the orderer
+	Rejected  int32 // transactions which reach the orderer but are not accepted
+
+	EndorseTimeouts   int32 // proposals dropped because no endorser answers before the endorsement deadline
+	BroadcastTimeouts int32 // envelopes not acknowledged before the broadcast deadline
+	Hedged            int32 // proposals hedged to another endorser in the same org
+
+	Evaluated  int32 // transactions whose responses are evaluated in the query mode
+	Mismatched int32 // evaluated transactions whose responses do not meet the expectation
 }
 
 func NewMetricInstance() *MetricInstance {
@@ -19,3 +35,72 @@ func NewMetricInstance() *MetricInstance {
 func (m *MetricInstance) AddAbort() {
 	atomic.AddInt32(&m.Abort, 1)
 }
+
+func (m *MetricInstance) AddValid() {
+	atomic.AddInt32(&m.Valid, 1)
+}
+
+func (m *MetricInstance) AddObserved() {
+	atomic.AddInt32(&m.Observed, 1)
+}
+
+func (m *MetricInstance) AddBroadcast() {
+	atomic.AddInt32(&m.Broadcast, 1)
+}
+
+func (m *MetricInstance) AddDropped() {
+	atomic.AddInt32(&m.Dropped, 1)
+}
+
+func (m *MetricInstance) AddRejected() {
+	atomic.AddInt32(&m.Rejected, 1)
+}
+
+func (m *MetricInstance) AddEndorseTimeout() {
+	atomic.AddInt32(&m.EndorseTimeouts, 1)
+}
+
+func (m *MetricInstance) AddBroadcastTimeout() {
+	atomic.AddInt32(&m.BroadcastTimeouts, 1)
+}
+
+func (m *MetricInstance) AddHedged() {
+	atomic.AddInt32(&m.Hedged, 1)
+}
+
+func (m *MetricInstance) AddEvaluated() {
+	atomic.AddInt32(&m.Evaluated, 1)
+}
+
+func (m *MetricInstance) AddMismatched() {
+	atomic.AddInt32(&m.Mismatched, 1)
+}
+
+// averageLatencyMs returns the average of latencies in nanosecond as millisecond
+func averageLatencyMs(latencies []int64) float64 {
+	if len(latencies) == 0 {
+		return 0.0
+	}
+
+	var sum int64
+	for _, l := range latencies {
+		sum += l
+	}
+	return float64(sum) / float64(len(latencies)) / float64(1e6)
+}
+
+// percentileMs returns the p-th percentile of latencies in nanosecond as millisecond
+func percentileMs(latencies []int64, p float64) float64 {
+	if len(latencies) == 0 {
+		return 0.0
+	}
+
+	sorted := append([]int64(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	index := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return float64(sorted[index]) / float64(1e6)
+}
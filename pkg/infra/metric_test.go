@@ -0,0 +1,41 @@
+package infra
+
+import (
+	"testing"
+)
+
+func TestPercentileMs(t *testing.T) {
+	// 1ms to 100ms, out of order
+	var hundred []int64
+	for i := 100; i >= 1; i-- {
+		hundred = append(hundred, int64(i)*1e6)
+	}
+
+	tests := []struct {
+		name      string
+		latencies []int64
+		p         float64
+		want      float64
+	}{
+		{"no latency", nil, 99, 0},
+		{"single latency", []int64{5e6}, 99, 5},
+		{"zeroth percentile is the minimum", hundred, 0, 1},
+		{"median", hundred, 50, 50},
+		{"p99", hundred, 99, 99},
+		{"p100 is the maximum", hundred, 100, 100},
+		{"nearest rank rounds up", []int64{1e6, 2e6, 3e6}, 50, 2},
+		{"fraction of millisecond", []int64{1500000, 2500000}, 100, 2.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentileMs(tt.latencies, tt.p); got != tt.want {
+				t.Errorf("percentileMs(p%v) = %f, want %f", tt.p, got, tt.want)
+			}
+		})
+	}
+
+	if hundred[0] != 100e6 {
+		t.Errorf("percentileMs sorts the latencies of the caller")
+	}
+}
@@ -1,97 +1,487 @@
 package infra
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/GwanWingYan/fabric-protos-go/ledger/rwset"
 	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
 )
 
-type Observer struct {
-	client    peer.Deliver_DeliverFilteredClient
-	deliverCh chan *peer.DeliverResponse_FilteredBlock
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 10 * time.Second
+	outageTimeFormat    = "15:04:05.000"
+
+	// completionCheckInterval is how often the observer checks completion without any new block
+	completionCheckInterval = 100 * time.Millisecond
+)
+
+// errStreamRefused means the committer ends the deliver stream with a status which reconnecting does not help,
+// e.g. if the identity is FORBIDDEN or the channel is NOT_FOUND
+var errStreamRefused = errors.New("deliver stream refused")
+
+// observedBlock is a filtered block received from one of the committers
+type observedBlock struct {
+	committerIndex int
+	channelIndex   int
+	receivedTime   int64
+	block          *peer.FilteredBlock
+	fullBlock      *common.Block                       // nil in the 'filtered' mode
+	privateData    map[uint64]*rwset.TxPvtReadWriteSet // private data indexed by the position in the block, only in the 'private' mode
 }
 
-func NewObserver() *Observer {
-	deliverer, err := CreateDeliverFilteredClient()
-	if err != nil {
-		logger.Fatalf("Fail to create DeliverFilteredClient: %v", err)
-	}
+// privateDataStat counts the valid transactions committed on one committer and how many of them come with private data
+type privateDataStat struct {
+	valid       int
+	withPrivate int
+}
 
-	envelope, err := CreateSignedDeliverNewestEnv()
-	if err != nil {
-		logger.Fatalf("Fail to create SignedEnvelope: %v", err)
-	}
+// Observers listen to blocks of every channel from all committers. A transaction is considered
+// committed once it is observed on a quorum of committers.
+type Observers struct {
+	observers   []*Observer // one for each channel on each committer
+	deliverCh   chan *observedBlock
+	failedCh    chan int       // index of each committer on which an observer gives up
+	failed      map[int]bool   // committers which are given up
+	seen        map[string]int // number of committers on which each transaction is observed
+	quorum      int
+	blocks      []*BlockRecorder  // statistics of full blocks of each channel from the first committer
+	privateData []privateDataStat // private data received from each committer in the 'private' mode
+}
 
-	if err = deliverer.Send(envelope); err != nil {
-		logger.Fatalf("Fail to send SignedEnvelope: %v", err)
+func NewObservers() *Observers {
+	deliverCh := make(chan *observedBlock)
+	failedCh := make(chan int)
+
+	var observers []*Observer
+	for i, committer := range config.Committers {
+		for j := range config.Channels {
+			observers = append(observers, NewObserver(i, j, committer, deliverCh, failedCh))
+		}
 	}
 
-	// drain the first response
-	if _, err = deliverer.Recv(); err != nil {
-		logger.Fatalf("Fail to receive the first response: %v", err)
+	blocks := make([]*BlockRecorder, len(config.Channels))
+	for i, channel := range config.Channels {
+		blocks[i] = NewBlockRecorder(channel)
 	}
 
-	return &Observer{
-		client:    deliverer,
-		deliverCh: make(chan *peer.DeliverResponse_FilteredBlock),
+	return &Observers{
+		observers:   observers,
+		deliverCh:   deliverCh,
+		failedCh:    failedCh,
+		failed:      make(map[int]bool),
+		seen:        make(map[string]int),
+		quorum:      config.CommitQuorum,
+		blocks:      blocks,
+		privateData: make([]privateDataStat, len(config.Committers)),
 	}
 }
 
-// StartAsync starts observing
-func (o *Observer) StartAsync() {
-	logger.Infof("Start observer\n")
+// StartAsync starts observing on every committer
+func (obs *Observers) StartAsync() {
+	logger.Infof("Start observers on %d channels of %d committers with quorum %d\n", len(config.Channels), len(config.Committers), obs.quorum)
 
 	// Process FilteredBlock
-	go o.processFilteredBlock()
+	goWorker(obs.processFilteredBlock)
 
-	go o.receiveFilteredBlock()
+	for _, o := range obs.observers {
+		goWorker(o.receiveFilteredBlock)
+	}
 }
 
-func (o *Observer) processFilteredBlock() {
-	var validTxNum int32 = 0
+func (obs *Observers) processFilteredBlock() {
+	timeout := time.Duration(config.ObserverTimeout) * time.Second
+	idleTimer := time.NewTimer(timeout)
+	defer idleTimer.Stop()
+	checkTicker := time.NewTicker(completionCheckInterval)
+	defer checkTicker.Stop()
+
 	for {
 		select {
-		case fb := <-o.deliverCh:
-			for _, tx := range fb.FilteredBlock.FilteredTransactions {
-				timeKeepers.keepObservedTime(tx.GetTxid(), tx.TxValidationCode)
-			}
+		case ob := <-obs.deliverCh:
+			for i, tx := range ob.block.FilteredTransactions {
+				txid := tx.GetTxid()
+				if _, ok := txid2id[txid]; !ok {
+					// Not a transaction generated in this run
+					continue
+				}
+
+				if timeKeepers.isCommitted(txid, ob.committerIndex) {
+					// Delivered again after the observer resumes
+					continue
+				}
+				timeKeepers.keepCommittedTime(txid, ob.committerIndex, ob.receivedTime)
+
+				if ob.privateData != nil && tx.TxValidationCode == peer.TxValidationCode_VALID {
+					stat := &obs.privateData[ob.committerIndex]
+					stat.valid++
+					if _, ok := ob.privateData[uint64(i)]; ok {
+						stat.withPrivate++
+					}
+				}
 
-			for _, tx := range fb.FilteredBlock.FilteredTransactions {
+				obs.seen[txid]++
+				if obs.seen[txid] != obs.quorum {
+					continue
+				}
+
+				// Observed on enough committers
+				timeKeepers.keepObservedTime(txid, tx.TxValidationCode)
+				completeTx(txid)
+
+				Metric.AddObserved()
 				if tx.TxValidationCode == peer.TxValidationCode_VALID {
-					validTxNum += 1
+					Metric.AddValid()
 				} else {
 					Metric.AddAbort()
 				}
 			}
 
-			if validTxNum+Metric.Abort >= int32(config.TxNum) {
+			if ob.fullBlock != nil && ob.committerIndex == 0 {
+				obs.blocks[ob.channelIndex].record(ob.fullBlock, ob.receivedTime)
+			}
+
+			// Any block means the committers are still making progress
+			if !idleTimer.Stop() {
+				<-idleTimer.C
+			}
+			idleTimer.Reset(timeout)
+
+			if isComplete() {
+				close(observerEndCh)
+				return
+			}
+		case i := <-obs.failedCh:
+			if obs.failed[i] {
+				continue
+			}
+			obs.failed[i] = true
+
+			// Transactions cannot be observed on the quorum any more
+			if left := len(config.Committers) - len(obs.failed); left < obs.quorum {
+				logger.Errorf("Only %d committers are left, fewer than the quorum %d, stop waiting for the remaining transactions", left, obs.quorum)
 				close(observerEndCh)
 				return
 			}
-		case <-time.After(20 * time.Second):
+		case <-checkTicker.C:
+			// Transactions may be dropped without any new block
+			if isComplete() {
+				close(observerEndCh)
+				return
+			}
+		case <-idleTimer.C:
+			logger.Warnf("No block is observed in %v, stop waiting for the remaining transactions", timeout)
 			close(observerEndCh)
 			return
 		}
 	}
 }
 
+// isComplete returns true if enough transactions are observed according to the completion mode
+func isComplete() bool {
+	observed := atomic.LoadInt32(&Metric.Observed)
+	broadcast := atomic.LoadInt32(&Metric.Broadcast)
+	dropped := atomic.LoadInt32(&Metric.Dropped)
+	rejected := atomic.LoadInt32(&Metric.Rejected)
+
+	switch config.Completion {
+	case "submitted":
+		// Every transaction is observed
+		return observed >= int32(config.TxNum)
+	case "percentage":
+		return float64(observed) >= config.CompletionPercent/100*float64(config.TxNum)
+	default:
+		// Every transaction either reaches the orderer or is dropped, and every one reaching the orderer is observed or rejected
+		return broadcast+dropped >= int32(config.TxNum) && observed+rejected >= broadcast
+	}
+}
+
+// report writes the commit lag of each committer behind the fastest one
+// and the disconnections of each observer to the report
+func (obs *Observers) report(endTime time.Time) {
+	lags := make([][]int64, len(config.Committers))
+	for _, tk := range timeKeepers.transactions {
+		var first int64
+		for _, t := range tk.CommittedTimes {
+			if t != 0 && (first == 0 || t < first) {
+				first = t
+			}
+		}
+		for i, t := range tk.CommittedTimes {
+			if t != 0 {
+				lags[i] = append(lags[i], t-first)
+			}
+		}
+	}
+
+	reportCh <- fmt.Sprintf("committer                      observed lag-avg(ms) lag-p99(ms) lag-max(ms)")
+	for i, committer := range config.Committers {
+		reportCh <- fmt.Sprintf("%-30s %8d %11.2f %11.2f %11.2f",
+			committer.Address,
+			len(lags[i]),
+			averageLatencyMs(lags[i]),
+			percentileMs(lags[i], 99),
+			percentileMs(lags[i], 100),
+		)
+	}
+
+	for _, o := range obs.observers {
+		o.reportOutages(endTime)
+	}
+
+	if config.DeliverMode == "private" {
+		reportCh <- fmt.Sprintf("committer                         valid with-private-data")
+		for i, committer := range config.Committers {
+			reportCh <- fmt.Sprintf("%-30s %8d %17d", committer.Address, obs.privateData[i].valid, obs.privateData[i].withPrivate)
+			if missing := obs.privateData[i].valid - obs.privateData[i].withPrivate; missing > 0 {
+				logger.Warnf("%d valid transactions are committed on %s without private data", missing, committer.Address)
+			}
+		}
+	}
+
+	reportBlocks(obs.blocks)
+}
+
+// outage is a period in which the observer is disconnected from the committer
+type outage struct {
+	start int64
+	end   int64 // 0 if the observer is still disconnected
+	cause error
+}
+
+// Observer receives blocks of one channel from one committer
+type Observer struct {
+	committerIndex int
+	channelIndex   int
+	channel        string
+	node           Node
+	address        string
+	client         DeliverClient
+	conn           *grpc.ClientConn // the connection under 'client'
+	lastBlock      uint64           // number of the last block received
+	outages        []*outage
+	lock           sync.Mutex // protects outages
+	outCh          chan *observedBlock
+	failCh         chan int // receives 'committerIndex' once the observer gives up
+	done           chan struct{}
+}
+
+func NewObserver(committerIndex int, channelIndex int, committer Node, outCh chan *observedBlock, failCh chan int) *Observer {
+	o := &Observer{
+		committerIndex: committerIndex,
+		channelIndex:   channelIndex,
+		channel:        config.Channels[channelIndex],
+		node:           committer,
+		address:        committer.Address,
+		outCh:          outCh,
+		failCh:         failCh,
+		done:           doneCh,
+	}
+
+	envelope, err := CreateSignedDeliverNewestEnv(o.channel)
+	if err != nil {
+		logger.Fatalf("Fail to create SignedEnvelope: %v", err)
+	}
+
+	if err = o.connect(envelope); err != nil {
+		logger.Fatalf("Fail to connect to %s on %s: %v", committer.Address, o.channel, err)
+	}
+
+	// drain the first response, which is the newest block before the run
+	deliverResponse, err := o.client.Recv()
+	if err != nil {
+		logger.Fatalf("Fail to receive the first response from %s on %s: %v", committer.Address, o.channel, err)
+	}
+	switch t := deliverResponse.Type.(type) {
+	case *peer.DeliverResponse_FilteredBlock:
+		o.lastBlock = t.FilteredBlock.Number
+	case *peer.DeliverResponse_Block:
+		o.lastBlock = t.Block.Header.Number
+	case *peer.DeliverResponse_BlockAndPrivateData:
+		o.lastBlock = t.BlockAndPrivateData.Block.Header.Number
+	case *peer.DeliverResponse_Status:
+		logger.Fatalf("Fail to receive the first block from %s on %s: status %s", committer.Address, o.channel, t.Status)
+	}
+
+	return o
+}
+
+// connect opens a deliver stream to the committer and seeks with 'envelope',
+// replacing the connection of the broken stream if any
+func (o *Observer) connect(envelope *common.Envelope) error {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+
+	deliverer, conn, err := CreateDeliverClient(o.node)
+	if err != nil {
+		return errors.Wrap(err, "fail to create DeliverClient")
+	}
+	trackConn(conn)
+
+	if err = deliverer.Send(envelope); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "fail to send SignedEnvelope")
+	}
+
+	o.client = deliverer
+	o.conn = conn
+	return nil
+}
+
+// reconnect keeps connecting to the committer with exponential backoff,
+// and resumes the deliver stream from the block next to the last one received.
+// It returns false if the run ends before reconnecting.
+func (o *Observer) reconnect(cause error) bool {
+	ot := &outage{start: time.Now().UnixNano(), cause: cause}
+	o.lock.Lock()
+	o.outages = append(o.outages, ot)
+	o.lock.Unlock()
+
+	backoff := minReconnectBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-o.done:
+			return false
+		}
+
+		envelope, err := CreateSignedDeliverSpecifiedEnv(o.channel, o.lastBlock+1)
+		if err != nil {
+			logger.Fatalf("Fail to create SignedEnvelope: %v", err)
+		}
+
+		err = o.connect(envelope)
+		if err == nil {
+			o.lock.Lock()
+			ot.end = time.Now().UnixNano()
+			o.lock.Unlock()
+
+			logger.Infof("Reconnect to %s on %s from block %d after %v", o.address, o.channel, o.lastBlock+1, time.Duration(ot.end-ot.start))
+			return true
+		}
+
+		logger.Warnf("Fail to reconnect to %s on %s, retry in %v: %v", o.address, o.channel, backoff, err)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
 func (o *Observer) receiveFilteredBlock() {
+	for {
+		err := o.receive()
+
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+
+		if errors.Cause(err) == errStreamRefused {
+			o.fail(err)
+			return
+		}
+
+		logger.Warnf("Lose deliver stream from %s on %s after block %d: %v", o.address, o.channel, o.lastBlock, err)
+		if !o.reconnect(err) {
+			return
+		}
+	}
+}
+
+// fail records the committer as disconnected until the end, and reports it to the observers
+func (o *Observer) fail(cause error) {
+	logger.Errorf("Give up deliver stream from %s on %s after block %d: %v", o.address, o.channel, o.lastBlock, cause)
+
+	o.lock.Lock()
+	o.outages = append(o.outages, &outage{start: time.Now().UnixNano(), cause: cause})
+	o.lock.Unlock()
+
+	select {
+	case o.failCh <- o.committerIndex:
+	case <-o.done:
+	}
+}
+
+// receive forwards blocks until the stream breaks or the run ends
+func (o *Observer) receive() error {
 	for {
 		deliverResponse, err := o.client.Recv()
 		if err != nil {
-			logger.Fatalln("Fail to receive deliver response: %v", err)
+			return errors.Wrap(err, "fail to receive deliver response")
 		}
 		if deliverResponse == nil {
-			logger.Fatalln("Received a nil DeliverResponse")
+			return errors.New("received a nil DeliverResponse")
+		}
+
+		ob := &observedBlock{
+			committerIndex: o.committerIndex,
+			channelIndex:   o.channelIndex,
+			receivedTime:   time.Now().UnixNano(),
 		}
 
 		switch t := deliverResponse.Type.(type) {
 		case *peer.DeliverResponse_FilteredBlock:
-			o.deliverCh <- t
+			ob.block = t.FilteredBlock
+		case *peer.DeliverResponse_Block:
+			ob.block = filterBlock(t.Block)
+			ob.fullBlock = t.Block
+		case *peer.DeliverResponse_BlockAndPrivateData:
+			ob.block = filterBlock(t.BlockAndPrivateData.Block)
+			ob.fullBlock = t.BlockAndPrivateData.Block
+			ob.privateData = t.BlockAndPrivateData.PrivateDataMap
+			if ob.privateData == nil {
+				// Distinguish a block without any private data from the other modes
+				ob.privateData = make(map[uint64]*rwset.TxPvtReadWriteSet)
+			}
 		case *peer.DeliverResponse_Status:
-			logger.Infoln("Status:", t.Status)
+			if t.Status != common.Status_SERVICE_UNAVAILABLE {
+				return errors.Wrapf(errStreamRefused, "status %s", t.Status)
+			}
+			return errors.Errorf("deliver stream ends with status %s", t.Status)
 		default:
 			logger.Infoln("Unknown DeliverResponse type")
+			continue
+		}
+
+		o.lastBlock = ob.block.Number
+		select {
+		case o.outCh <- ob:
+		case <-o.done:
+			return nil
+		}
+	}
+}
+
+// reportOutages writes every disconnection and how long the observer was blind to the report
+func (o *Observer) reportOutages(endTime time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var blind time.Duration
+	for _, ot := range o.outages {
+		end := ot.end
+		if end == 0 {
+			end = endTime.UnixNano()
+		}
+		blind += time.Duration(end - ot.start)
+	}
+	reportCh <- fmt.Sprintf("Committer %s on %s: %d disconnections, blind for %.3fs", o.address, o.channel, len(o.outages), blind.Seconds())
+
+	for _, ot := range o.outages {
+		if ot.end == 0 {
+			reportCh <- fmt.Sprintf("    since %s, still disconnected at the end: %v", time.Unix(0, ot.start).Format(outageTimeFormat), ot.cause)
+		} else {
+			reportCh <- fmt.Sprintf("    from %s, blind for %.3fs: %v", time.Unix(0, ot.start).Format(outageTimeFormat), float64(ot.end-ot.start)/float64(1e9), ot.cause)
 		}
 	}
 }
@@ -0,0 +1,424 @@
+package infra
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GwanWingYan/HLF-2.2/protoutil"
+	"github.com/GwanWingYan/fabric-protos-go/common"
+	"github.com/GwanWingYan/fabric-protos-go/ledger/rwset"
+	"github.com/GwanWingYan/fabric-protos-go/orderer"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// filteredBlock builds a filtered block containing transactions with the given validation codes
+func filteredBlock(codes map[string]peer.TxValidationCode) *peer.FilteredBlock {
+	block := &peer.FilteredBlock{}
+	for txid, code := range codes {
+		block.FilteredTransactions = append(block.FilteredTransactions, &peer.FilteredTransaction{
+			Txid:             txid,
+			TxValidationCode: code,
+		})
+	}
+	return block
+}
+
+func TestObserversQuorum(t *testing.T) {
+	defer func(c *Config, m map[string]int, tks TimeKeepers, l chan string, e chan struct{}, mi *MetricInstance) {
+		config, txid2id, timeKeepers, logCh, observerEndCh, Metric = c, m, tks, l, e, mi
+	}(config, txid2id, timeKeepers, logCh, observerEndCh, Metric)
+
+	config = &Config{TxNum: 2, Committers: make([]Node, 3), CommitQuorum: 2, ObserverTimeout: 10, Completion: "submitted"}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	observerEndCh = make(chan struct{})
+	Metric = NewMetricInstance()
+
+	obs := &Observers{
+		deliverCh: make(chan *observedBlock),
+		seen:      make(map[string]int),
+		quorum:    config.CommitQuorum,
+	}
+	go obs.processFilteredBlock()
+
+	valid, mvcc := peer.TxValidationCode_VALID, peer.TxValidationCode_MVCC_READ_CONFLICT
+	deliveries := []struct {
+		committerIndex int
+		codes          map[string]peer.TxValidationCode
+	}{
+		{0, map[string]peer.TxValidationCode{"tx0": valid, "other": valid}},
+		{1, map[string]peer.TxValidationCode{"tx0": valid}},
+		// tx0 is already observed on the quorum, so the third committer must not count it again
+		{2, map[string]peer.TxValidationCode{"tx0": valid}},
+		{2, map[string]peer.TxValidationCode{"tx1": mvcc}},
+		// Nothing is generated in this run, which only makes sure the previous block is processed
+		{0, nil},
+		{0, map[string]peer.TxValidationCode{"tx1": mvcc}},
+	}
+
+	for i, d := range deliveries {
+		select {
+		case obs.deliverCh <- &observedBlock{committerIndex: d.committerIndex, receivedTime: int64(i + 1), block: filteredBlock(d.codes)}:
+		case <-observerEndCh:
+			t.Fatalf("observers end before delivery %d", i)
+		}
+	}
+
+	select {
+	case <-observerEndCh:
+	case <-time.After(time.Second):
+		t.Fatalf("observers do not end after every transaction is observed on the quorum")
+	}
+
+	if Metric.Abort != 1 {
+		t.Errorf("Abort = %d, want 1", Metric.Abort)
+	}
+	for i, tk := range timeKeepers.transactions {
+		if tk.ObservedTime == 0 {
+			t.Errorf("tx%d is not observed", i)
+		}
+	}
+	wantCommitted := [][]int64{{1, 2, 3}, {6, 0, 4}}
+	for i, want := range wantCommitted {
+		for j, w := range want {
+			if got := timeKeepers.transactions[i].CommittedTimes[j]; got != w {
+				t.Errorf("tx%d is committed on committer %d at %d, want %d", i, j, got, w)
+			}
+		}
+	}
+}
+
+func TestObserversPrivateData(t *testing.T) {
+	defer func(c *Config, m map[string]int, tks TimeKeepers, l chan string, e chan struct{}, mi *MetricInstance) {
+		config, txid2id, timeKeepers, logCh, observerEndCh, Metric = c, m, tks, l, e, mi
+	}(config, txid2id, timeKeepers, logCh, observerEndCh, Metric)
+
+	config = &Config{TxNum: 3, Committers: make([]Node, 2), CommitQuorum: 2, ObserverTimeout: 10, Completion: "submitted"}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1, "tx2": 2}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	observerEndCh = make(chan struct{})
+	Metric = NewMetricInstance()
+
+	obs := &Observers{
+		deliverCh:   make(chan *observedBlock),
+		seen:        make(map[string]int),
+		quorum:      config.CommitQuorum,
+		privateData: make([]privateDataStat, 2),
+	}
+	go obs.processFilteredBlock()
+
+	block := &peer.FilteredBlock{FilteredTransactions: []*peer.FilteredTransaction{
+		{Txid: "tx0", TxValidationCode: peer.TxValidationCode_VALID},
+		{Txid: "tx1", TxValidationCode: peer.TxValidationCode_VALID},
+		{Txid: "tx2", TxValidationCode: peer.TxValidationCode_MVCC_READ_CONFLICT},
+	}}
+	// Only the first transaction comes with private data, and the invalid one is not counted
+	obs.deliverCh <- &observedBlock{committerIndex: 1, block: block, privateData: map[uint64]*rwset.TxPvtReadWriteSet{0: {}, 2: {}}}
+	// Blocks without private data are not counted either, as they are not received in the 'private' mode
+	obs.deliverCh <- &observedBlock{committerIndex: 0, block: block}
+
+	select {
+	case <-observerEndCh:
+	case <-time.After(time.Second):
+		t.Fatalf("observers do not end after every transaction is observed on the quorum")
+	}
+
+	want := []privateDataStat{{}, {valid: 2, withPrivate: 1}}
+	for i, w := range want {
+		if obs.privateData[i] != w {
+			t.Errorf("private data of committer %d = %+v, want %+v", i, obs.privateData[i], w)
+		}
+	}
+}
+
+func TestObserversFailedCommitters(t *testing.T) {
+	defer func(c *Config, m map[string]int, tks TimeKeepers, l chan string, e chan struct{}, mi *MetricInstance) {
+		config, txid2id, timeKeepers, logCh, observerEndCh, Metric = c, m, tks, l, e, mi
+	}(config, txid2id, timeKeepers, logCh, observerEndCh, Metric)
+
+	tests := []struct {
+		name         string
+		failed       []int
+		wantObserved int32
+	}{
+		{"quorum left", []int{0}, 1},
+		// Failing on more channels of the same committer counts once
+		{"same committer again", []int{0, 0}, 1},
+		{"fewer than the quorum", []int{0, 1}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{TxNum: 1, Committers: make([]Node, 3), CommitQuorum: 2, ObserverTimeout: 10, Completion: "submitted"}
+			txid2id = map[string]int{"tx0": 0}
+			initTimeKeepers()
+			logCh = make(chan string, 100)
+			observerEndCh = make(chan struct{})
+			Metric = NewMetricInstance()
+
+			obs := &Observers{
+				deliverCh: make(chan *observedBlock),
+				failedCh:  make(chan int),
+				failed:    make(map[int]bool),
+				seen:      make(map[string]int),
+				quorum:    config.CommitQuorum,
+			}
+			go obs.processFilteredBlock()
+
+			for _, i := range tt.failed {
+				obs.failedCh <- i
+			}
+			// The committers left observe the transaction if they are still enough
+			for _, i := range []int{1, 2} {
+				select {
+				case obs.deliverCh <- &observedBlock{committerIndex: i, block: filteredBlock(map[string]peer.TxValidationCode{"tx0": peer.TxValidationCode_VALID})}:
+				case <-observerEndCh:
+				}
+			}
+
+			select {
+			case <-observerEndCh:
+			case <-time.After(time.Second):
+				t.Fatalf("observers do not end")
+			}
+			if Metric.Observed != tt.wantObserved {
+				t.Errorf("Observed = %d, want %d", Metric.Observed, tt.wantObserved)
+			}
+		})
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	defer func(c *Config, mi *MetricInstance) { config, Metric = c, mi }(config, Metric)
+
+	tests := []struct {
+		name       string
+		completion string
+		percent    float64
+		metric     MetricInstance
+		want       bool
+	}{
+		{"broadcast: all observed", "broadcast", 0, MetricInstance{Observed: 10, Broadcast: 10}, true},
+		{"broadcast: dropped ones are not waited for", "broadcast", 0, MetricInstance{Observed: 7, Broadcast: 7, Dropped: 3}, true},
+		{"broadcast: some not observed", "broadcast", 0, MetricInstance{Observed: 6, Broadcast: 7, Dropped: 3}, false},
+		{"broadcast: some still in flight", "broadcast", 0, MetricInstance{Observed: 5, Broadcast: 5, Dropped: 3}, false},
+		{"submitted: all observed", "submitted", 0, MetricInstance{Observed: 10, Broadcast: 10}, true},
+		{"submitted: dropped ones are waited for", "submitted", 0, MetricInstance{Observed: 7, Broadcast: 7, Dropped: 3}, false},
+		{"percentage: reached", "percentage", 70, MetricInstance{Observed: 7, Broadcast: 10}, true},
+		{"percentage: not reached", "percentage", 75, MetricInstance{Observed: 7, Broadcast: 10}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{TxNum: 10, Completion: tt.completion, CompletionPercent: tt.percent}
+			metric := tt.metric
+			Metric = &metric
+			if got := isComplete(); got != tt.want {
+				t.Errorf("isComplete() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testIdentity returns a client identity which is good enough to sign envelopes
+func testIdentity(t *testing.T) *Crypto {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Fail to generate key: %v", err)
+	}
+	return &Crypto{Creator: []byte("tester"), PrivKey: key}
+}
+
+// fakeDeliverServer is a committer whose newest block is 5. It breaks the first
+// deliver stream after block 6, and then serves blocks up to 7 on later streams.
+type fakeDeliverServer struct {
+	peer.UnimplementedDeliverServer
+	lock    sync.Mutex
+	starts  []uint64 // the block each stream seeks from
+	streams int
+}
+
+func (s *fakeDeliverServer) DeliverFiltered(stream peer.Deliver_DeliverFilteredServer) error {
+	envelope, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	payload, err := protoutil.UnmarshalPayload(envelope.Payload)
+	if err != nil {
+		return err
+	}
+	seekInfo := &orderer.SeekInfo{}
+	if err = proto.Unmarshal(payload.Data, seekInfo); err != nil {
+		return err
+	}
+
+	start := uint64(5)
+	if specified := seekInfo.Start.GetSpecified(); specified != nil {
+		start = specified.Number
+	}
+
+	s.lock.Lock()
+	s.starts = append(s.starts, start)
+	s.streams++
+	first := s.streams == 1
+	s.lock.Unlock()
+
+	last := uint64(7)
+	if first {
+		last = 6
+	}
+	for n := start; n <= last; n++ {
+		if err = stream.Send(&peer.DeliverResponse{
+			Type: &peer.DeliverResponse_FilteredBlock{FilteredBlock: &peer.FilteredBlock{Number: n}},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if first {
+		return errors.New("peer restarts")
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestObserverReconnect(t *testing.T) {
+	defer func(c *Config, l *log.Logger, d chan struct{}) {
+		config, logger, doneCh = c, l, d
+	}(config, logger, doneCh)
+
+	logger = log.New()
+	config = &Config{Channels: []string{"test"}, Identity: testIdentity(t), DeliverMode: "filtered"}
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	deliverServer := &fakeDeliverServer{}
+	peer.RegisterDeliverServer(server, deliverServer)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	outCh := make(chan *observedBlock)
+	o := NewObserver(0, 0, Node{Address: lis.Addr().String()}, outCh, make(chan int))
+	if o.lastBlock != 5 {
+		t.Fatalf("lastBlock = %d after connecting, want the newest block 5", o.lastBlock)
+	}
+	go o.receiveFilteredBlock()
+
+	for _, want := range []uint64{6, 7} {
+		select {
+		case ob := <-outCh:
+			if ob.block.Number != want {
+				t.Fatalf("received block %d, want %d", ob.block.Number, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("block %d is not received", want)
+		}
+	}
+
+	deliverServer.lock.Lock()
+	starts := deliverServer.starts
+	deliverServer.lock.Unlock()
+	if len(starts) != 2 || starts[1] != 7 {
+		t.Errorf("streams seek from %v, want the second one to resume from block 7", starts)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.outages) != 1 || o.outages[0].end == 0 {
+		t.Errorf("outages = %v, want one which has ended", o.outages)
+	}
+}
+
+// refusingDeliverServer is a committer whose newest block is 5, and which refuses to deliver any later block
+type refusingDeliverServer struct {
+	peer.UnimplementedDeliverServer
+	lock    sync.Mutex
+	streams int
+}
+
+func (s *refusingDeliverServer) DeliverFiltered(stream peer.Deliver_DeliverFilteredServer) error {
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.streams++
+	s.lock.Unlock()
+
+	if err := stream.Send(&peer.DeliverResponse{
+		Type: &peer.DeliverResponse_FilteredBlock{FilteredBlock: &peer.FilteredBlock{Number: 5}},
+	}); err != nil {
+		return err
+	}
+	return stream.Send(&peer.DeliverResponse{Type: &peer.DeliverResponse_Status{Status: common.Status_FORBIDDEN}})
+}
+
+func TestObserverRefused(t *testing.T) {
+	defer func(c *Config, l *log.Logger, d chan struct{}) {
+		config, logger, doneCh = c, l, d
+	}(config, logger, doneCh)
+
+	logger = log.New()
+	config = &Config{Channels: []string{"test"}, Identity: testIdentity(t), DeliverMode: "filtered"}
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	deliverServer := &refusingDeliverServer{}
+	peer.RegisterDeliverServer(server, deliverServer)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	failCh := make(chan int)
+	o := NewObserver(1, 0, Node{Address: lis.Addr().String()}, make(chan *observedBlock), failCh)
+	received := make(chan struct{})
+	go func() {
+		o.receiveFilteredBlock()
+		close(received)
+	}()
+
+	select {
+	case i := <-failCh:
+		if i != 1 {
+			t.Errorf("committer %d fails, want 1", i)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the refused observer does not fail")
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("the refused observer keeps receiving")
+	}
+
+	deliverServer.lock.Lock()
+	defer deliverServer.lock.Unlock()
+	if deliverServer.streams != 1 {
+		t.Errorf("%d streams, want no reconnection", deliverServer.streams)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.outages) != 1 || o.outages[0].end != 0 {
+		t.Errorf("outages = %v, want one until the end", o.outages)
+	}
+}
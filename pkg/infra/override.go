@@ -0,0 +1,221 @@
+package infra
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	envPrefix = "TAPE_"
+)
+
+var (
+	// reservedEnvs are the TAPE_ environment variables which are not config fields
+	reservedEnvs = map[string]bool{
+		"TAPE_LOGLEVEL": true,
+	}
+
+	// setSegmentPattern matches a segment of an override path, e.g. 'endorsers[0]'
+	setSegmentPattern = regexp.MustCompile(`^([A-Za-z0-9]+)((?:\[[0-9]+\])*)$`)
+	setIndexPattern   = regexp.MustCompile(`\[([0-9]+)\]`)
+)
+
+// pathElement is either a field, matched against the YAML key, or an index of a list
+type pathElement struct {
+	field string
+	index int // -1 for a field
+}
+
+// applyOverrides sets the fields given by TAPE_ environment variables, e.g. TAPE_ENDORSERS_0_ADDRESS,
+// and then the ones given by 'sets' in the form of 'path=value', e.g. 'endorsers[0].address=localhost:7051'.
+// Fields of environment variables are matched case-insensitively. Values are parsed as YAML,
+// so that lists and maps can be given inline, e.g. 'args=[GetAllAssets]', except for strings which are taken as is.
+// An index equal to the length of a list appends to it.
+// An environment variable which does not start with a top-level field is not meant for tape, so it is skipped.
+func (c *Config) applyOverrides(environ []string, sets []string) error {
+	errs := &validationError{}
+
+	sort.Strings(environ)
+	for _, env := range environ {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], envPrefix) || reservedEnvs[kv[0]] {
+			continue
+		}
+		path := parseEnvPath(strings.TrimPrefix(kv[0], envPrefix))
+		if _, ok := fieldIndexByKey(reflect.TypeOf(*c), path[0].field, true); !ok || path[0].index >= 0 {
+			logger.Warnf("Ignore %s, which is not a field of the config", kv[0])
+			continue
+		}
+		errs.add(kv[0], c.override(path, kv[1], true))
+	}
+
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 {
+			errs.addf(set, "override must be in the form of 'path=value'")
+			continue
+		}
+		path, err := parseSetPath(kv[0])
+		if err != nil {
+			errs.add(kv[0], err)
+			continue
+		}
+		errs.add(kv[0], c.override(path, kv[1], false))
+	}
+
+	return errs.err()
+}
+
+// parseEnvPath splits the name of an environment variable without the prefix by '_',
+// where a number is an index
+func parseEnvPath(name string) []pathElement {
+	var path []pathElement
+	for _, s := range strings.Split(name, "_") {
+		if i, err := strconv.Atoi(s); err == nil {
+			path = append(path, pathElement{index: i})
+		} else {
+			path = append(path, pathElement{field: s, index: -1})
+		}
+	}
+	return path
+}
+
+// parseSetPath splits a path like 'endorsers[0].grpc.dialTimeout' into fields and indices
+func parseSetPath(s string) ([]pathElement, error) {
+	var path []pathElement
+	for _, segment := range strings.Split(s, ".") {
+		m := setSegmentPattern.FindStringSubmatch(segment)
+		if m == nil {
+			return nil, errors.Errorf("invalid path segment %q", segment)
+		}
+		path = append(path, pathElement{field: m[1], index: -1})
+		for _, index := range setIndexPattern.FindAllStringSubmatch(m[2], -1) {
+			i, _ := strconv.Atoi(index[1])
+			path = append(path, pathElement{index: i})
+		}
+	}
+	return path, nil
+}
+
+// override sets the field at 'path' to 'value'
+func (c *Config) override(path []pathElement, value string, ignoreCase bool) error {
+	v := reflect.ValueOf(c).Elem()
+	for i, e := range path {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+
+		if e.index >= 0 {
+			if v.Kind() != reflect.Slice {
+				return errors.Errorf("index %d of %s, which is not a list", e.index, v.Type())
+			}
+			if e.index > v.Len() {
+				return errors.Errorf("index %d is out of range, the list has %d elements", e.index, v.Len())
+			}
+			if e.index == v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			v = v.Index(e.index)
+			continue
+		}
+
+		// An entry of a map, e.g. 'transient', is the last element of the path
+		if v.Kind() == reflect.Map && i == len(path)-1 {
+			entry := reflect.New(v.Type().Elem())
+			if err := parseOverride(entry.Elem(), value); err != nil {
+				return err
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			v.SetMapIndex(reflect.ValueOf(e.field), entry.Elem())
+			logger.Infof("Override %s with %q", formatPath(path), value)
+			return nil
+		}
+
+		if v.Kind() != reflect.Struct {
+			return errors.Errorf("field %s of %s, which has no field", e.field, v.Type())
+		}
+		field, ok := fieldByKey(v, e.field, ignoreCase)
+		if !ok {
+			return errors.Errorf("unknown field %s in type %s", e.field, v.Type())
+		}
+		v = field
+	}
+
+	if err := parseOverride(v, value); err != nil {
+		return err
+	}
+	logger.Infof("Override %s with %q", formatPath(path), value)
+	return nil
+}
+
+// fieldByKey returns the field of the struct whose YAML key is 'key'
+func fieldByKey(v reflect.Value, key string, ignoreCase bool) (reflect.Value, bool) {
+	i, ok := fieldIndexByKey(v.Type(), key, ignoreCase)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return v.Field(i), true
+}
+
+// fieldIndexByKey returns the index of the field of the struct type whose YAML key is 'key'
+func fieldIndexByKey(t reflect.Type, key string, ignoreCase bool) (int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if name == key || ignoreCase && strings.EqualFold(name, key) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseOverride sets 'v' to 'value', which is parsed as YAML unless 'v' is a string
+func parseOverride(v reflect.Value, value string) error {
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+
+	parsed := reflect.New(v.Type())
+	if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+		return errors.Errorf("invalid value %q for %s: %s", value, v.Type(), strings.Replace(err.Error(), "\n", " ", -1))
+	}
+	v.Set(parsed.Elem())
+	return nil
+}
+
+// formatPath formats 'path' in the form of the 'path' of '--set'
+func formatPath(path []pathElement) string {
+	var b strings.Builder
+	for i, e := range path {
+		switch {
+		case e.index >= 0:
+			b.WriteString("[" + strconv.Itoa(e.index) + "]")
+		case i > 0:
+			b.WriteString("." + e.field)
+		default:
+			b.WriteString(e.field)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,194 @@
+package infra
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want []pathElement
+	}{
+		{"CHANNEL", []pathElement{{field: "CHANNEL", index: -1}}},
+		{"ENDORSERS_0_ADDRESS", []pathElement{{field: "ENDORSERS", index: -1}, {index: 0}, {field: "ADDRESS", index: -1}}},
+		{"ENDORSERS_12_GRPC_DIALTIMEOUT", []pathElement{{field: "ENDORSERS", index: -1}, {index: 12}, {field: "GRPC", index: -1}, {field: "DIALTIMEOUT", index: -1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseEnvPath(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEnvPath(%s) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSetPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    []pathElement
+		wantErr bool
+	}{
+		{"field", "channel", []pathElement{{field: "channel", index: -1}}, false},
+		{"nested field", "endorsers[0].grpc.dialTimeout", []pathElement{{field: "endorsers", index: -1}, {index: 0}, {field: "grpc", index: -1}, {field: "dialTimeout", index: -1}}, false},
+		{"several indices", "matrix[1][2]", []pathElement{{field: "matrix", index: -1}, {index: 1}, {index: 2}}, false},
+		{"empty segment", "endorsers..address", nil, true},
+		{"index without field", "[0]", nil, true},
+		{"negative index", "endorsers[-1]", nil, true},
+		{"unclosed index", "endorsers[0", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSetPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSetPath(%s) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSetPath(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string // in the form of an environment variable if 'env', otherwise of a set
+		env     bool
+		value   string
+		get     func(c *Config) interface{}
+		want    interface{}
+		wantErr string // a part of the error, empty if succeeded
+	}{
+		{
+			name: "string", path: "channel", value: "yourchannel",
+			get: func(c *Config) interface{} { return c.Channel }, want: "yourchannel",
+		},
+		{
+			name: "number", path: "txNum", value: "100",
+			get: func(c *Config) interface{} { return c.TxNum }, want: 100,
+		},
+		{
+			name: "string that looks like a number", path: "version", value: "1.0",
+			get: func(c *Config) interface{} { return c.Version }, want: "1.0",
+		},
+		{
+			name: "inline list", path: "args", value: "[GetAllAssets, asset1]",
+			get: func(c *Config) interface{} { return c.Args }, want: []string{"GetAllAssets", "asset1"},
+		},
+		{
+			name: "field of an element", path: "endorsers[0].grpc.dialTimeout", value: "1000",
+			get: func(c *Config) interface{} { return c.Endorsers[0].GRPC.DialTimeout }, want: 1000,
+		},
+		{
+			name: "element", path: "args[0]", value: "ReadAsset",
+			get: func(c *Config) interface{} { return c.Args }, want: []string{"ReadAsset"},
+		},
+		{
+			name: "append to a list", path: "endorsers[1].address", value: "peer1:7051",
+			get:  func(c *Config) interface{} { return []string{c.Endorsers[0].Address, c.Endorsers[1].Address} },
+			want: []string{"peer0:7051", "peer1:7051"},
+		},
+		{
+			name: "append to an empty list", path: "orderers[0].address", value: "orderer:7050",
+			get: func(c *Config) interface{} { return c.Orderers }, want: []Node{{Address: "orderer:7050"}},
+		},
+		{
+			name: "entry of a map", path: "transient.key", value: "value",
+			get: func(c *Config) interface{} { return c.Transient }, want: map[string]string{"key": "value"},
+		},
+		{
+			name: "field behind a pointer", path: "expect.reads", value: "2",
+			get: func(c *Config) interface{} { return *c.Expect.Reads }, want: 2,
+		},
+		{
+			name: "environment variable", path: "ENDORSERS_0_ADDRESS", env: true, value: "peer1:7051",
+			get: func(c *Config) interface{} { return c.Endorsers[0].Address }, want: "peer1:7051",
+		},
+		{
+			name: "environment variable of a camel case field", path: "TXNUM", env: true, value: "100",
+			get: func(c *Config) interface{} { return c.TxNum }, want: 100,
+		},
+		{name: "index out of range", path: "endorsers[2].address", value: "peer2:7051", wantErr: "out of range"},
+		{name: "unknown field", path: "chanel", value: "yourchannel", wantErr: "unknown field chanel"},
+		{name: "case of a set", path: "txnum", value: "100", wantErr: "unknown field txnum"},
+		{name: "index of a field", path: "channel[0]", value: "yourchannel", wantErr: "not a list"},
+		{name: "field of a string", path: "channel.name", value: "yourchannel", wantErr: "has no field"},
+		{name: "invalid value", path: "txNum", value: "many", wantErr: "many"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Endorsers: []Node{{Address: "peer0:7051"}}, Args: []string{"GetAllAssets"}}
+
+			var path []pathElement
+			if tt.env {
+				path = parseEnvPath(tt.path)
+			} else {
+				var err error
+				if path, err = parseSetPath(tt.path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := c.override(path, tt.value, tt.env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("override() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("override() error = %v", err)
+			}
+			if got := tt.get(c); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	c := &Config{Channel: "mychannel", TxNum: 10}
+	environ := []string{
+		"PATH=/usr/bin",
+		"TAPE_LOGLEVEL=debug",
+		"TAPE_FOO=bar",
+		"TAPE_0=zero",
+		"TAPE_CHANNEL=yourchannel",
+		"TAPE_ENDORSERS_0_ADDRESS=peer0:7051",
+		"TAPE_RATE=fast",
+	}
+	sets := []string{
+		"txNum=100",
+		"channel=ourchannel",
+		"burst",
+		"endorsers[x].address=peer1:7051",
+	}
+
+	err := c.applyOverrides(environ, sets)
+
+	// Sets are applied after the environment variables
+	if c.Channel != "ourchannel" || c.TxNum != 100 || len(c.Endorsers) != 1 || c.Endorsers[0].Address != "peer0:7051" {
+		t.Errorf("config = {channel: %s, txNum: %d, endorsers: %v}, want {channel: ourchannel, txNum: 100, endorsers: [peer0:7051]}",
+			c.Channel, c.TxNum, c.Endorsers)
+	}
+
+	errs, ok := err.(*validationError)
+	if !ok {
+		t.Fatalf("applyOverrides() error = %v, want the problems", err)
+	}
+	want := []string{"TAPE_RATE: ", "burst: ", "endorsers[x].address: invalid path segment"}
+	if len(errs.problems) != len(want) {
+		t.Fatalf("problems = %q, want %q", errs.problems, want)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(errs.problems[i], prefix) {
+			t.Errorf("problem %d = %q, want %q", i, errs.problems[i], prefix)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -15,9 +16,10 @@ const (
 )
 
 var (
-	txid2id map[string]int
-	config  *Config
-	logger  *log.Logger
+	txid2id   map[string]int
+	txTargets []int // index of the target of each transaction
+	config    *Config
+	logger    = log.New() // replaced by the caller's logger, used as is while loading the config
 )
 
 var (
@@ -31,6 +33,13 @@ var (
 	doneCh        chan struct{}
 )
 
+var (
+	workers     sync.WaitGroup     // every goroutine of the pipeline of the current run
+	runConns    []*grpc.ClientConn // every connection of the current run
+	connsLock   sync.Mutex         // protects runConns and connsClosed
+	connsClosed bool               // true once the connections of the current run are closed
+)
+
 // isBreakdownPhase1 returns true if this round is phase 1,
 // false if this round is phase 2
 func isBreakdownPhase1() bool {
@@ -43,7 +52,12 @@ func Process(c *Config, l *log.Logger) {
 	config = c
 	logger = l
 
-	if config.End2End {
+	mustCheckTLS()
+
+	if config.Query {
+		logger.Info("Test Mode: Query")
+		Query()
+	} else if config.End2End {
 		logger.Info("Test Mode: End To End")
 		End2End()
 	} else {
@@ -84,6 +98,9 @@ func WriteLogToFile(printWG *sync.WaitGroup) {
 	}
 	defer reportFile.Close()
 
+	// The effective config comes first, so that the settings of the run are kept with its results
+	reportFile.WriteString("Effective config:\n" + effectiveConfig() + "\n")
+
 	for {
 		select {
 		case s := <-logCh:
@@ -110,10 +127,10 @@ func NewReportChannel() chan string {
 }
 
 func NewUnsignedChannel() chan *Element {
-	// unsignedCh stores all unsigned transactions
+	// unsignedCh stores all unsigned transactions, which are all generated before signing starts
 	// Sender: initiator
 	// Receiver: signers
-	unsignedCh := make(chan *Element, config.Burst)
+	unsignedCh := make(chan *Element, config.TxNum)
 	return unsignedCh
 }
 
@@ -166,20 +183,133 @@ func initChannels() {
 	doneCh = initDoneChannel()
 }
 
-func WaitObserverEnd(startTime time.Time, printWG *sync.WaitGroup) {
+// initPipeline prepares the tracking of the goroutines and connections of a new run
+func initPipeline() {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	runConns = nil
+	connsClosed = false
+}
+
+// goWorker runs 'f' in a goroutine of the pipeline, which stopPipeline waits for
+func goWorker(f func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		f()
+	}()
+}
+
+// trackConn records a connection of the current run, which stopPipeline closes.
+// A connection made after that, e.g. by a reconnecting observer, is closed at once.
+func trackConn(conn *grpc.ClientConn) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if connsClosed {
+		conn.Close()
+		return
+	}
+	runConns = append(runConns, conn)
+}
+
+// stopPipeline closes every connection of the run, so that no goroutine stays blocked on a stream,
+// and waits for every goroutine of the pipeline to return. 'doneCh' must be closed before,
+// then nothing of this run is left behind for the next one, e.g. the next trial of the search.
+func stopPipeline() {
+	connsLock.Lock()
+	connsClosed = true
+	conns := runConns
+	runConns = nil
+	connsLock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	workers.Wait()
+}
+
+// Summary contains the key results of one run
+type Summary struct {
+	Duration   time.Duration
+	Observed   int     // number of transactions observed by the committer
+	CommitTPS  float64 // rate at which transactions are observed, from the first to the last one
+	P99Latency float64 // 99th percentile end-to-end latency in millisecond
+}
+
+func summarize(duration time.Duration) *Summary {
+	s := &Summary{Duration: duration}
+
+	var firstObserved, lastObserved int64
+	var latencies []int64
+	for _, tk := range timeKeepers.transactions {
+		if tk.ObservedTime == 0 {
+			continue
+		}
+		if firstObserved == 0 || tk.ObservedTime < firstObserved {
+			firstObserved = tk.ObservedTime
+		}
+		if tk.ObservedTime > lastObserved {
+			lastObserved = tk.ObservedTime
+		}
+		latencies = append(latencies, tk.ObservedTime-tk.ProposedTime)
+	}
+
+	s.Observed = len(latencies)
+	if lastObserved > firstObserved {
+		s.CommitTPS = float64(s.Observed-1) * 1e9 / float64(lastObserved-firstObserved)
+	}
+	s.P99Latency = percentileMs(latencies, 99)
+
+	return s
+}
+
+func WaitObserverEnd(startTime time.Time, broadcasters *Broadcasters, observers *Observers, virtualClients *VirtualClients, printWG *sync.WaitGroup) *Summary {
 	select {
 	case <-observerEndCh:
-		duration := time.Since(startTime)
+		endTime := time.Now()
+		duration := endTime.Sub(startTime)
 		logger.Infof("Finish processing transactions")
 
 		reportCh <- fmt.Sprintf("Number of ALL Transactions: %d", config.TxNum)
-		reportCh <- fmt.Sprintf("Number of VALID Transactions: %d", int32(config.TxNum)-Metric.Abort)
+		reportCh <- fmt.Sprintf("Number of VALID Transactions: %d", Metric.Valid)
 		reportCh <- fmt.Sprintf("Number of ABORTED Transactions: %d", Metric.Abort)
+		reportCh <- fmt.Sprintf("Number of DROPPED Transactions: %d", Metric.Dropped)
+		reportCh <- fmt.Sprintf("Number of REJECTED Transactions: %d", Metric.Rejected)
+		reportCh <- fmt.Sprintf("Number of TIMED OUT Proposals: %d, Envelopes: %d", Metric.EndorseTimeouts, Metric.BroadcastTimeouts)
+		reportCh <- fmt.Sprintf("Number of HEDGED Proposals: %d", Metric.Hedged)
+		mismatches.report()
 		reportCh <- fmt.Sprintf("Duration: %.3fs", float64(duration.Milliseconds())/float64(1e3))
 		reportCh <- fmt.Sprintf("TPS: %f", float64(config.TxNum)*1e9/float64(duration.Nanoseconds()))
 		reportCh <- fmt.Sprintf("Abort Rate: %.3f%%", float64(Metric.Abort)/float64(config.TxNum)*100)
+		reportRateLimiters(startTime)
+		endorserStats.report(duration)
+		broadcasters.report(duration)
+		reportChannels(duration)
+		if virtualClients != nil {
+			virtualClients.report(duration)
+		}
+		observers.report(endTime)
 
-		reportCh <- fmt.Sprintf("id    endorse(ms) integrate(ms) order&commit(ms)")
+		steadyTPS, err := steadyStateTPS(startTime, endTime)
+		if err != nil {
+			logger.Warnf("Fail to compute steady-state TPS: %v", err)
+		} else {
+			reportCh <- fmt.Sprintf("Steady-state TPS (excluding %ds warm-up and %ds cool-down): %f", config.WarmUp, config.CoolDown, steadyTPS)
+		}
+
+		schedule.reportPhases(startTime, endTime)
+
+		mustWriteTimeSeries(startTime, endTime)
+		reportCh <- fmt.Sprintf("Time series: %s", config.TimeSeriesPath)
+		if config.CheckRWSet {
+			reportCh <- fmt.Sprintf("Read/write sets: %s", config.RWSetPath)
+		}
+
+		reportLostTransactions()
+
+		reportCh <- fmt.Sprintf("id    endorse(ms) integrate(ms)  ack(ms) ack-to-commit(ms)")
 		for i, tk := range timeKeepers.transactions {
 			endorsementDuration := float64(tk.EndorsedTime-tk.ProposedTime) / float64(1e6)
 			if endorsementDuration < 0.0 {
@@ -191,55 +321,112 @@ func WaitObserverEnd(startTime time.Time, printWG *sync.WaitGroup) {
 				integrationDuration = 0.0
 			}
 
-			orderingDuration := float64(tk.ObservedTime-tk.BroadcastTime) / float64(1e6)
-			if orderingDuration < 0.0 {
-				orderingDuration = 0.0
+			ackDuration := float64(tk.OrderedTime-tk.BroadcastTime) / float64(1e6)
+			if ackDuration < 0.0 {
+				ackDuration = 0.0
 			}
 
-			reportCh <- fmt.Sprintf("%-5d %11.2f %13.2f %16.2f",
+			commitDuration := float64(tk.ObservedTime-tk.OrderedTime) / float64(1e6)
+			if commitDuration < 0.0 || tk.OrderedTime == 0 {
+				commitDuration = 0.0
+			}
+
+			reportCh <- fmt.Sprintf("%-5d %11.2f %13.2f %8.2f %17.2f",
 				i,
 				endorsementDuration,
 				integrationDuration,
-				orderingDuration,
+				ackDuration,
+				commitDuration,
 			)
 		}
 
 		// Closing 'doneCh', a channel which is never sent an element, is a common technique to notify ending in Golang
 		// More information: https://go101.org/article/channel-use-cases.html#check-closed-status
 		close(doneCh)
+		stopPipeline()
+		rwsetDumper.close()
 
 		// Wait for WriteLogToFile() to return
 		printWG.Wait()
+
+		return summarize(duration)
 	}
 }
 
+// newVirtualClientsIfClosedLoop returns the channel signers receive raw transactions from.
+// In the closed-loop mode, virtual clients admit transactions to signers one at a time.
+func newVirtualClientsIfClosedLoop() (chan *Element, *VirtualClients) {
+	if !isClosedLoop() {
+		return unsignedCh, nil
+	}
+
+	signerInCh := make(chan *Element)
+	return signerInCh, NewVirtualClients(unsignedCh, signerInCh)
+}
+
+// startGenerating starts feeding transactions into the pipeline and returns the start time of the run
+func startGenerating(initiator *Initiator, signers *Signers, virtualClients *VirtualClients) time.Time {
+	if isClosedLoop() {
+		startTime := time.Now()
+		signers.StartAsync()
+		virtualClients.StartAsync()
+		// Virtual clients consume raw transactions gradually, so do not wait for them
+		goWorker(initiator.StartSync)
+		return startTime
+	}
+
+	initiator.StartSync() // Block until all raw transactions are ready
+
+	startTime := time.Now()
+	schedule.Start(startTime)
+	startRateLimiters()
+	signers.StartAsync()
+	return startTime
+}
+
+// runBenchmark runs the benchmark of the configured mode once
+func runBenchmark() *Summary {
+	if config.Query {
+		return Query()
+	}
+	return End2End()
+}
+
 // End2End executes end-to-end benchmark on HLF
 // An Element (i.e. a transaction) will go through the following channels
 // unsignedCh -> signedCh -> endorsedCh -> integratedCh
-func End2End() {
+func End2End() *Summary {
+	Metric = NewMetricInstance()
+	initPipeline()
 	initChannels()
 	initTimeKeepers()
+	schedule = NewSchedule()
+	initRateLimiters()
+	initCompletions()
+	initMismatches()
+	initEndorserStats()
+	initRWSetDumper()
 
 	printWG := &sync.WaitGroup{}
 	go WriteLogToFile(printWG)
 
 	initiator := NewInitiator(unsignedCh)
-	signers := NewSigners(unsignedCh, signedChs)
+	signerInCh, virtualClients := newVirtualClientsIfClosedLoop()
+
+	signers := NewSigners(signerInCh, signedChs)
 	proposers := NewProposers(signedChs, endorsedCh)
 	integrators := NewIntegrators(endorsedCh, integratedCh)
 	broadcasters := NewBroadcasters(integratedCh)
-	observer := NewObserver()
+	observers := NewObservers()
 
 	proposers.StartAsync()
 	integrators.StartAsync()
 	broadcasters.StartAsync()
-	observer.StartAsync()
-	initiator.StartSync() // Block until all raw transactions are ready
+	observers.StartAsync()
 
-	startTime := time.Now()
-	signers.StartAsync()
+	startTime := startGenerating(initiator, signers, virtualClients)
 
-	WaitObserverEnd(startTime, printWG)
+	return WaitObserverEnd(startTime, broadcasters, observers, virtualClients, printWG)
 }
 
 //TODO
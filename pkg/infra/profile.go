@@ -0,0 +1,237 @@
+package infra
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// connectionProfile is the part of the common connection profile used by tape, in YAML or JSON
+type connectionProfile struct {
+	Client struct {
+		Organization string `yaml:"organization"`
+	} `yaml:"client"`
+	Organizations map[string]profileOrganization `yaml:"organizations"`
+	Peers         map[string]profileNode         `yaml:"peers"`
+	Orderers      map[string]profileNode         `yaml:"orderers"`
+	Channels      map[string]profileChannel      `yaml:"channels"`
+}
+
+type profileOrganization struct {
+	MSPID           string      `yaml:"mspid"`
+	Peers           []string    `yaml:"peers"`
+	AdminPrivateKey profileFile `yaml:"adminPrivateKey"`
+	SignedCert      profileFile `yaml:"signedCert"`
+}
+
+// profileFile is given either by a path or inline
+type profileFile struct {
+	Path string      `yaml:"path"`
+	PEM  interface{} `yaml:"pem"` // a PEM string, or a list of them
+}
+
+type profileNode struct {
+	URL         string                 `yaml:"url"`
+	TLSCACerts  profileFile            `yaml:"tlsCACerts"`
+	GRPCOptions map[string]interface{} `yaml:"grpcOptions"`
+}
+
+type profileChannel struct {
+	Orderers []string                      `yaml:"orderers"`
+	Peers    map[string]profileChannelPeer `yaml:"peers"`
+}
+
+type profileChannelPeer struct {
+	EndorsingPeer *bool `yaml:"endorsingPeer"` // true if absent
+	EventSource   *bool `yaml:"eventSource"`   // true if absent
+}
+
+// loadConnectionProfile fills in the endorsers, committers, orderers and client identity
+// which are not provided in the config from the connection profile.
+// Relative paths in the profile are relative to the profile itself.
+func (c *Config) loadConnectionProfile() error {
+	if c.ConnectionProfile == "" {
+		return nil
+	}
+
+	path := c.ConnectionProfile
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "fail to load connection profile %s", path)
+	}
+	profile := &connectionProfile{}
+	if err = yaml.Unmarshal(raw, profile); err != nil {
+		return errors.Wrapf(err, "fail to unmarshal connection profile %s", path)
+	}
+	dir := filepath.Dir(path)
+
+	mspids := make(map[string]string)
+	for _, org := range profile.Organizations {
+		for _, peer := range org.Peers {
+			mspids[peer] = org.MSPID
+		}
+	}
+
+	channel := c.Targets[0].Channel
+	channelConfig, hasChannel := profile.Channels[channel]
+	if !hasChannel {
+		logger.Warnf("Channel %s is not in connection profile %s, all peers and orderers are used", channel, path)
+	}
+
+	// peers selects the peers of the channel with the role, or all peers if the channel is not in the profile
+	peers := func(role func(profileChannelPeer) *bool) ([]Node, error) {
+		var names []string
+		if hasChannel {
+			for name, p := range channelConfig.Peers {
+				if r := role(p); r == nil || *r {
+					names = append(names, name)
+				}
+			}
+		} else {
+			for name := range profile.Peers {
+				names = append(names, name)
+			}
+		}
+		return resolveNodes(profile.Peers, names, mspids, dir)
+	}
+
+	if len(c.Endorsers) == 0 && !c.Discovery.enabled() {
+		if c.Endorsers, err = peers(func(p profileChannelPeer) *bool { return p.EndorsingPeer }); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Committers) == 0 && c.Committer.Address == "" {
+		if c.Committers, err = peers(func(p profileChannelPeer) *bool { return p.EventSource }); err != nil {
+			return err
+		}
+	}
+
+	if len(c.Orderers) == 0 && c.Orderer.Address == "" {
+		names := channelConfig.Orderers
+		if len(names) == 0 {
+			for name := range profile.Orderers {
+				names = append(names, name)
+			}
+		}
+		if c.Orderers, err = resolveNodes(profile.Orderers, names, mspids, dir); err != nil {
+			return err
+		}
+	}
+
+	if org, ok := profile.Organizations[profile.Client.Organization]; ok {
+		if c.MSPID == "" {
+			c.MSPID = org.MSPID
+		}
+		if c.PrivateKey == "" {
+			c.PrivateKey, c.privateKeyPEM = org.AdminPrivateKey.resolve(dir)
+		}
+		if c.SignCert == "" {
+			c.SignCert, c.signCertPEM = org.SignedCert.resolve(dir)
+		}
+	}
+
+	return nil
+}
+
+// resolveNodes converts the named nodes of the profile to nodes, sorted by name
+func resolveNodes(nodes map[string]profileNode, names []string, mspids map[string]string, dir string) ([]Node, error) {
+	sort.Strings(names)
+
+	var resolved []Node
+	for _, name := range names {
+		pn, ok := nodes[name]
+		if !ok {
+			return nil, errors.Errorf("node %s is not defined in the connection profile", name)
+		}
+		node, err := pn.toNode(mspids[name], dir)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid node %s in the connection profile", name)
+		}
+		resolved = append(resolved, node)
+	}
+	return resolved, nil
+}
+
+func (pn *profileNode) toNode(mspid string, dir string) (Node, error) {
+	node := Node{
+		Address: pn.URL,
+		Org:     mspid,
+	}
+
+	if strings.Contains(pn.URL, "://") {
+		u, err := url.Parse(pn.URL)
+		if err != nil {
+			return node, errors.Wrapf(err, "invalid url %s", pn.URL)
+		}
+		node.Address = u.Host
+		if u.Scheme != "grpcs" {
+			return node, nil
+		}
+	}
+
+	node.TLSCACert, node.TLSCACertByte = pn.TLSCACerts.resolve(dir)
+
+	for key, value := range pn.GRPCOptions {
+		switch key {
+		case "ssl-target-name-override", "hostnameOverride":
+			if name, ok := value.(string); ok {
+				node.GRPC.ServerNameOverride = name
+			}
+		case "grpc.keepalive_time_ms":
+			node.GRPC.KeepaliveInterval = (intOption(value) + 999) / 1000
+		case "grpc.keepalive_timeout_ms":
+			node.GRPC.KeepaliveTimeout = (intOption(value) + 999) / 1000
+		case "grpc.max_receive_message_length":
+			node.GRPC.MaxRecvMsgSize = intOption(value)
+		case "grpc.max_send_message_length":
+			node.GRPC.MaxSendMsgSize = intOption(value)
+		}
+	}
+
+	return node, nil
+}
+
+// resolve returns the path relative to 'dir' if the file is given by a path, otherwise the inline PEM
+func (pf *profileFile) resolve(dir string) (string, []byte) {
+	if pf.Path != "" {
+		if filepath.IsAbs(pf.Path) {
+			return pf.Path, nil
+		}
+		return filepath.Join(dir, pf.Path), nil
+	}
+
+	switch pem := pf.PEM.(type) {
+	case string:
+		return "", []byte(pem)
+	case []interface{}:
+		var pems []byte
+		for _, p := range pem {
+			if s, ok := p.(string); ok {
+				pems = append(pems, []byte(strings.TrimSpace(s)+"\n")...)
+			}
+		}
+		return "", pems
+	}
+	return "", nil
+}
+
+// intOption returns the value of a numeric gRPC option, which may be written as a string, or 0 if invalid
+func intOption(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,96 @@
+package infra
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProfileFileResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     profileFile
+		wantPath string
+		wantPEM  string
+	}{
+		{"nothing", profileFile{}, "", ""},
+		{"relative path", profileFile{Path: "crypto/ca.pem"}, "/profiles/crypto/ca.pem", ""},
+		{"absolute path", profileFile{Path: "/crypto/ca.pem"}, "/crypto/ca.pem", ""},
+		{"path goes first", profileFile{Path: "ca.pem", PEM: "inline"}, "/profiles/ca.pem", ""},
+		{"inline PEM", profileFile{PEM: "-----BEGIN CERTIFICATE-----\n"}, "", "-----BEGIN CERTIFICATE-----\n"},
+		{"list of PEMs", profileFile{PEM: []interface{}{"first\n\n", " second"}}, "", "first\nsecond\n"},
+		{"unknown PEM", profileFile{PEM: 42}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, pem := tt.file.resolve("/profiles")
+			if path != tt.wantPath || string(pem) != tt.wantPEM {
+				t.Errorf("resolve() = (%q, %q), want (%q, %q)", path, pem, tt.wantPath, tt.wantPEM)
+			}
+		})
+	}
+}
+
+func TestProfileNodeToNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    profileNode
+		want    Node
+		wantErr bool
+	}{
+		{
+			name: "address without scheme",
+			node: profileNode{URL: "peer0:7051", TLSCACerts: profileFile{Path: "ca.pem"}},
+			want: Node{Address: "peer0:7051", Org: "Org1MSP", TLSCACert: "/profiles/ca.pem"},
+		},
+		{
+			name: "TLS",
+			node: profileNode{URL: "grpcs://peer0:7051", TLSCACerts: profileFile{PEM: "inline"}},
+			want: Node{Address: "peer0:7051", Org: "Org1MSP", TLSCACertByte: []byte("inline")},
+		},
+		{
+			name: "no TLS",
+			node: profileNode{URL: "grpc://peer0:7051", TLSCACerts: profileFile{Path: "ca.pem"}},
+			want: Node{Address: "peer0:7051", Org: "Org1MSP"},
+		},
+		{
+			name: "gRPC options",
+			node: profileNode{URL: "grpcs://peer0:7051", GRPCOptions: map[string]interface{}{
+				"ssl-target-name-override":        "peer0.org1.example.com",
+				"grpc.keepalive_time_ms":          120000,
+				"grpc.keepalive_timeout_ms":       "20001",
+				"grpc.max_receive_message_length": float64(1024),
+				"grpc.max_send_message_length":    "invalid",
+				"grpc-wait-for-ready-timeout":     30000,
+			}},
+			want: Node{Address: "peer0:7051", Org: "Org1MSP", GRPC: GRPCOptions{
+				ServerNameOverride: "peer0.org1.example.com",
+				KeepaliveInterval:  120,
+				KeepaliveTimeout:   21,
+				MaxRecvMsgSize:     1024,
+			}},
+		},
+		{
+			name: "hostname override",
+			node: profileNode{URL: "grpcs://peer0:7051", GRPCOptions: map[string]interface{}{"hostnameOverride": "peer0.org1.example.com"}},
+			want: Node{Address: "peer0:7051", Org: "Org1MSP", GRPC: GRPCOptions{ServerNameOverride: "peer0.org1.example.com"}},
+		},
+		{
+			name:    "invalid url",
+			node:    profileNode{URL: "grpcs://peer0:port"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := tt.node.toNode("Org1MSP", "/profiles")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("toNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(node, tt.want) {
+				t.Errorf("toNode() = %+v, want %+v", node, tt.want)
+			}
+		})
+	}
+}
@@ -3,10 +3,8 @@ package infra
 import (
 	"bytes"
 	"crypto/rand"
-	"fmt"
 	"math"
 
-	"github.com/GwanWingYan/HLF-2.2/core/ledger/kvledger/txmgmt/rwsetutil"
 	"github.com/GwanWingYan/HLF-2.2/protoutil"
 	"github.com/GwanWingYan/fabric-protos-go/common"
 	"github.com/GwanWingYan/fabric-protos-go/orderer"
@@ -25,8 +23,9 @@ func getRandomNonce() ([]byte, error) {
 	return key, nil
 }
 
-// CreateProposal creates an unsigned proposal based on the given information and returns a proposal and its transaction id
-func CreateProposal(txid string, channel, ccname, version string, args []string) (*peer.Proposal, string, error) {
+// CreateProposal creates an unsigned proposal based on the given information and returns a proposal and its transaction id.
+// 'transient' is passed to the chaincode without being recorded in the ledger, which is how private data is submitted.
+func CreateProposal(txid string, channel, ccname, version string, args []string, transient map[string][]byte) (*peer.Proposal, string, error) {
 	// convert the argument list to a byte list
 	var argsByte [][]byte
 	for _, arg := range args {
@@ -49,7 +48,7 @@ func CreateProposal(txid string, channel, ccname, version string, args []string)
 
 	if txid == "" {
 		// if transaction id is not provided, let the protoutil decides the ID
-		prop, txid, err := protoutil.CreateChaincodeProposal(common.HeaderType_ENDORSER_TRANSACTION, channel, invocation, creator)
+		prop, txid, err := protoutil.CreateChaincodeProposalWithTransient(common.HeaderType_ENDORSER_TRANSACTION, channel, invocation, creator, transient)
 		if err != nil {
 			return nil, "", err
 		}
@@ -58,7 +57,7 @@ func CreateProposal(txid string, channel, ccname, version string, args []string)
 		// To use a customized ID, we MUST disable txid check in
 		// core/endorser/msgvalidation.go:Validate and protoutil/proputils.go:ComputeTxID (v2)
 		nonce, err := getRandomNonce()
-		prop, txid, err := protoutil.CreateChaincodeProposalWithTxIDNonceAndTransient(txid, common.HeaderType_ENDORSER_TRANSACTION, channel, invocation, nonce, creator, nil)
+		prop, txid, err := protoutil.CreateChaincodeProposalWithTxIDNonceAndTransient(txid, common.HeaderType_ENDORSER_TRANSACTION, channel, invocation, nonce, creator, transient)
 		if err != nil {
 			return nil, "", err
 		}
@@ -91,10 +90,6 @@ func CreateSignedTx(proposal *peer.Proposal, responses []*peer.ProposalResponse)
 		return nil, errors.Errorf("Fail to find any response")
 	}
 
-	if config.CheckRWSet {
-		mustPrintTXRWSet(responses)
-	}
-
 	header, err := getHeader(proposal.Header)
 	if err != nil {
 		return nil, err
@@ -118,13 +113,27 @@ func CreateSignedTx(proposal *peer.Proposal, responses []*peer.ProposalResponse)
 	return generateEnvelope(payload)
 }
 
-func CreateSignedDeliverNewestEnv() (*common.Envelope, error) {
-	start := &orderer.SeekPosition{
+// CreateSignedDeliverNewestEnv creates an envelope to seek blocks of the channel from the newest one
+func CreateSignedDeliverNewestEnv(channel string) (*common.Envelope, error) {
+	return createSignedDeliverEnv(channel, &orderer.SeekPosition{
 		Type: &orderer.SeekPosition_Newest{
 			Newest: &orderer.SeekNewest{},
 		},
-	}
+	})
+}
+
+// CreateSignedDeliverSpecifiedEnv creates an envelope to seek blocks of the channel from the specified one
+func CreateSignedDeliverSpecifiedEnv(channel string, number uint64) (*common.Envelope, error) {
+	return createSignedDeliverEnv(channel, &orderer.SeekPosition{
+		Type: &orderer.SeekPosition_Specified{
+			Specified: &orderer.SeekSpecified{
+				Number: number,
+			},
+		},
+	})
+}
 
+func createSignedDeliverEnv(channel string, start *orderer.SeekPosition) (*common.Envelope, error) {
 	stop := &orderer.SeekPosition{
 		Type: &orderer.SeekPosition_Specified{
 			Specified: &orderer.SeekSpecified{
@@ -141,7 +150,7 @@ func CreateSignedDeliverNewestEnv() (*common.Envelope, error) {
 
 	return protoutil.CreateSignedEnvelope(
 		common.HeaderType_DELIVER_SEEK_INFO,
-		config.Channel,
+		channel,
 		config.Identity,
 		seekInfo,
 		0,
@@ -246,41 +255,6 @@ func GetChaincodeProposalPayload(ccProposalPayloadBytes []byte) (*peer.Chaincode
 	return ccProposalPayload, errors.Wrap(err, "error unmarshaling ChaincodeProposalPayload")
 }
 
-func mustPrintTXRWSet(responses []*peer.ProposalResponse) {
-	proposalResponsePayloadByte := getProposalResponsePayloadByte(responses)
-	proposalResponsePayload, err := protoutil.UnmarshalProposalResponsePayload(proposalResponsePayloadByte)
-	if err != nil {
-		logger.Errorf("Fail to unmarshal ProposalResponsePayload: %v", err)
-	}
-
-	ccAction, err := protoutil.UnmarshalChaincodeAction(proposalResponsePayload.Extension)
-	if err != nil {
-		logger.Errorf("Fail to unmarshal ChaincodeAction: %v", err)
-	}
-
-	txRWSet := &rwsetutil.TxRwSet{}
-	err = txRWSet.FromProtoBytes(ccAction.Results)
-	if err != nil {
-		if err != nil {
-			logger.Errorf("Fail to deserializes protobytes into TxReadWriteSet proto message: %v", err)
-		}
-	}
-
-	for _, rwset := range txRWSet.NsRwSets {
-		fmt.Println("Namespace:", rwset.NameSpace)
-
-		fmt.Println("Read Set")
-		for _, rset := range rwset.KvRwSet.Reads {
-			fmt.Println(rset.String())
-		}
-
-		fmt.Println("Write Set")
-		for _, wset := range rwset.KvRwSet.Writes {
-			fmt.Println(wset.String())
-		}
-	}
-}
-
 func generateChaincodeActionPayload(proposal *peer.Proposal, responses []*peer.ProposalResponse) (*peer.ChaincodeActionPayload, error) {
 	ccProposalPayload, err := GetChaincodeProposalPayload(proposal.Payload)
 	if err != nil {
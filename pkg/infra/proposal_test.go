@@ -0,0 +1,76 @@
+package infra
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCreateProposalTransient(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Identity: testIdentity(t)}
+
+	transient := map[string][]byte{"asset": []byte("secret")}
+	tests := []struct {
+		name      string
+		txid      string
+		transient map[string][]byte
+	}{
+		{"txid by protoutil", "", transient},
+		{"customized txid", "mytx", transient},
+		{"no transient data", "mytx", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prop, txid, err := CreateProposal(tt.txid, "mychannel", "basic", "1.0", []string{"Put", "k"}, tt.transient)
+			if err != nil {
+				t.Fatalf("CreateProposal() = %v", err)
+			}
+			if tt.txid != "" && txid != tt.txid {
+				t.Errorf("txid = %s, want %s", txid, tt.txid)
+			}
+
+			payload := &peer.ChaincodeProposalPayload{}
+			if err = proto.Unmarshal(prop.Payload, payload); err != nil {
+				t.Fatalf("Fail to unmarshal proposal payload: %v", err)
+			}
+			if len(payload.TransientMap) != len(tt.transient) {
+				t.Fatalf("TransientMap = %v, want %v", payload.TransientMap, tt.transient)
+			}
+			for k, v := range tt.transient {
+				if !bytes.Equal(payload.TransientMap[k], v) {
+					t.Errorf("TransientMap[%s] = %q, want %q", k, payload.TransientMap[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateTransientList(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+
+	// The first target has no transient data, while the second one has a random value per transaction
+	config = &Config{TxNum: 3, Targets: []Target{
+		{Chaincode: "basic"},
+		{Chaincode: "private", Transient: map[string]string{"collection": "private", "value": randomTransientValue}},
+	}}
+	list := generateTransientList([]int{0, 1, 1})
+
+	if list[0] != nil {
+		t.Errorf("transient map of transaction 0 = %v without transient data in its target, want nil", list[0])
+	}
+	for i, transient := range list[1:] {
+		if string(transient["collection"]) != "private" {
+			t.Errorf("transient[collection] of transaction %d = %q, want private", i+1, transient["collection"])
+		}
+		if len(transient["value"]) != 64 {
+			t.Errorf("transient[value] of transaction %d = %q, want a random string of 64 bytes", i+1, transient["value"])
+		}
+	}
+	if bytes.Equal(list[1]["value"], list[2]["value"]) {
+		t.Errorf("both transactions have transient value %q, want a different one for each", list[1]["value"])
+	}
+}
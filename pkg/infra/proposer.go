@@ -2,14 +2,31 @@ package infra
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+var (
+	endorserStats *EndorserStats
+)
+
+// TimeoutConfig is the deadlines of the calls to endorsers and orderers, in milliseconds.
+// A deadline of 0 means waiting forever.
+type TimeoutConfig struct {
+	Endorse   int `yaml:"endorse"`   // deadline of each proposal
+	Broadcast int `yaml:"broadcast"` // deadline of the acknowledgement of each envelope
+	Hedge     int `yaml:"hedge"`     // send the proposal to an endorser of the same org in another group as well if no response arrives in time, 0 to disable
+}
+
 type Proposers struct {
 	proposers [][]*Proposer
-	tokenCh   chan struct{}
+	limiter   *RateLimiter
 }
 
 func NewProposers(inCh []chan *Element, outCh chan *Element) *Proposers {
@@ -17,15 +34,17 @@ func NewProposers(inCh []chan *Element, outCh chan *Element) *Proposers {
 	// one Proposer for one connection
 
 	proposers := make([][]*Proposer, config.EndorserNum)
-	tokenCh := make(chan struct{}, int(config.Burst))
+	// Every transaction is sent to all endorsers in one group, each of which consumes a token
+	limiter := NewRateLimiter("Proposal", float64(config.EndorserNum)/float64(config.EndorserGroupNum))
 	expectTPS := float64(config.Rate) / float64(config.ConnNum*config.ClientPerConnNum*config.EndorserGroupNum)
 	for i, endorser := range config.Endorsers {
 		proposers[i] = make([]*Proposer, config.ConnNum)
 		for j := 0; j < config.ConnNum; j++ {
-			client, err := CreateEndorserClient(endorser)
+			client, conn, err := CreateEndorserClient(endorser)
 			if err != nil {
 				logger.Fatalf("Fail to create No. %d connection for endorser %s: %v", j, endorser.Address, err)
 			}
+			trackConn(conn)
 
 			proposers[i][j] = &Proposer{
 				endorserIndex: i,
@@ -35,14 +54,31 @@ func NewProposers(inCh []chan *Element, outCh chan *Element) *Proposers {
 				address:       endorser.Address,
 				inCh:          inCh[i],
 				outCh:         outCh,
-				tokenCh:       tokenCh,
+				limiter:       limiter,
+			}
+		}
+	}
+
+	// Proposals can be hedged to the connection of the same index of the endorsers in the same org.
+	// The endorsers in the same group already endorse the same transactions, so only the ones
+	// in the other groups can stand in without duplicating an endorsement.
+	for i, endorser := range config.Endorsers {
+		if endorser.Org == "" {
+			continue
+		}
+		for k, other := range config.Endorsers {
+			if k/config.EndorsersPerGroup == i/config.EndorsersPerGroup || other.Org != endorser.Org {
+				continue
+			}
+			for j := 0; j < config.ConnNum; j++ {
+				proposers[i][j].hedges = append(proposers[i][j].hedges, proposers[k][j])
 			}
 		}
 	}
 
 	return &Proposers{
 		proposers: proposers,
-		tokenCh:   tokenCh,
+		limiter:   limiter,
 	}
 }
 
@@ -50,25 +86,9 @@ func NewProposers(inCh []chan *Element, outCh chan *Element) *Proposers {
 func (ps *Proposers) StartAsync() {
 	logger.Infof("Start sending transactions")
 
-	// Use a token bucket to throttle the sending of proposals
-	go func() {
-		if config.Rate == 0 {
-			for {
-				ps.tokenCh <- struct{}{}
-			}
-		} else {
-			interval := 1e9 / float64(config.Rate) * float64(config.EndorserNum) / float64(config.EndorserGroupNum)
-			for {
-				time.Sleep(time.Duration(interval) * time.Nanosecond)
-				ps.tokenCh <- struct{}{}
-			}
-		}
-
-	}()
-
 	for i := 0; i < config.EndorserNum; i++ {
 		for j := 0; j < config.ConnNum; j++ {
-			go ps.proposers[i][j].Start()
+			goWorker(ps.proposers[i][j].Start)
 		}
 	}
 }
@@ -81,18 +101,36 @@ type Proposer struct {
 	address       string
 	inCh          chan *Element
 	outCh         chan *Element
-	tokenCh       chan struct{}
+	limiter       *RateLimiter
+	hedges        []*Proposer // proposers of the endorsers in the same org but in the other groups
+}
+
+// proposalResult is the outcome of one call to an endorser
+type proposalResult struct {
+	resp *peer.ProposalResponse
+	err  error
+}
+
+// failed returns true if the call fails or the endorser responds with a bad status
+func (r proposalResult) failed() bool {
+	return r.err != nil || r.resp.Response.Status < 200 || r.resp.Response.Status >= 400
+}
+
+// timedOut returns true if the endorser does not respond before the deadline
+func (r proposalResult) timedOut() bool {
+	return status.Code(r.err) == codes.DeadlineExceeded
 }
 
-func (p *Proposer) getToken() {
-	<-p.tokenCh
+func (p *Proposer) getToken() bool {
+	return p.limiter.Take()
 }
 
 // Start serves as the k-th client of the j-th connection to the endorser specified by channel 'signed'.
 // It collects signed proposals and send them to the endorser
 func (p *Proposer) Start() {
 	for k := 0; k < config.ClientPerConnNum; k++ {
-		go p.startClient(k)
+		clientIndex := k
+		goWorker(func() { p.startClient(clientIndex) })
 	}
 }
 
@@ -102,33 +140,171 @@ func (p *Proposer) startClient(clientIndex int) {
 		case element := <-p.inCh:
 			// Send signed proposal to peer for endorsement
 
-			p.getToken()
+			if !p.getToken() {
+				return
+			}
 
 			timeKeepers.keepProposedTime(element.Txid, p.endorserIndex, p.connIndex, clientIndex)
 
 			// send proposal
-			resp, err := p.client.ProcessProposal(context.Background(), element.SignedProposal)
-			if err != nil || resp.Response.Status < 200 || resp.Response.Status >= 400 {
+			result := p.process(element.SignedProposal)
+			resp, err := result.resp, result.err
+
+			// In the query mode, the status is checked against the expectation later
+			if err != nil || !config.Query && result.failed() {
 				if resp == nil {
 					logger.Errorf("Error processing proposal: %v, status: unknown, address: %s \n", err, p.address)
 				} else {
 					logger.Errorf("Error processing proposal: %v, status: %d, message: %s, address: %s \n", err, resp.Response.Status, resp.Response.Message, p.address)
 				}
+				if result.timedOut() {
+					Metric.AddEndorseTimeout()
+					timeKeepers.keepDropped(element.Txid, "endorsement timeout")
+				} else {
+					timeKeepers.keepDropped(element.Txid, "endorsement")
+				}
+				completeTx(element.Txid)
 				continue
 			}
 
 			element.lock.Lock()
 			element.Responses = append(element.Responses, resp)
-			if len(element.Responses) >= config.EndorserNum {
+			endorsed := len(element.Responses) == config.EndorsersPerGroup
+			element.lock.Unlock()
+
+			if endorsed {
 				// Collect enough endorsement for this transaction
-				p.outCh <- element
+				select {
+				case p.outCh <- element:
+				case <-doneCh:
+					return
+				}
 
 				timeKeepers.keepEndorsedTime(element.Txid, p.endorserIndex, p.connIndex, clientIndex)
+				completeEndorsedTx(element.Txid)
+				endorserStats.recordLast(p.endorserIndex)
 			}
-			element.lock.Unlock()
 
 		case <-doneCh:
 			return
 		}
 	}
 }
+
+// process sends the proposal to the endorser. If it does not respond within the hedge threshold,
+// the proposal is sent to an endorser of the same org in another group as well, and the first successful result wins.
+func (p *Proposer) process(signedProposal *peer.SignedProposal) proposalResult {
+	threshold := time.Duration(config.Timeout.Hedge) * time.Millisecond
+	if threshold == 0 || len(p.hedges) == 0 {
+		return p.call(signedProposal)
+	}
+
+	// Buffered, so that the loser does not block after the winner is taken
+	results := make(chan proposalResult, 2)
+	goWorker(func() {
+		results <- p.call(signedProposal)
+	})
+
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(threshold):
+	}
+
+	hedge := p.hedges[rand.Intn(len(p.hedges))]
+	logger.Debugf("No response from %s in %v, hedge the proposal to %s", p.address, threshold, hedge.address)
+	Metric.AddHedged()
+	goWorker(func() {
+		results <- hedge.call(signedProposal)
+	})
+
+	result := <-results
+	if result.failed() {
+		result = <-results
+	}
+	return result
+}
+
+// call sends the proposal to the endorser with the endorsement deadline,
+// and records the latency and outcome of the endorser
+func (p *Proposer) call(signedProposal *peer.SignedProposal) proposalResult {
+	ctx := context.Background()
+	if config.Timeout.Endorse > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Timeout.Endorse)*time.Millisecond)
+		defer cancel()
+	}
+
+	start := time.Now()
+	resp, err := p.client.ProcessProposal(ctx, signedProposal)
+	result := proposalResult{resp: resp, err: err}
+	endorserStats.record(p.endorserIndex, time.Since(start).Nanoseconds(), result.failed(), result.timedOut())
+
+	return result
+}
+
+// EndorserStats keeps the response latency and errors of each endorser
+type EndorserStats struct {
+	endorsers []*endorserStat
+}
+
+type endorserStat struct {
+	latencies []int64 // nanoseconds from sending the proposal to receiving the response, including errors
+	errors    int     // number of failed calls and responses with a bad status, including timeouts
+	timeouts  int     // number of calls without any response before the deadline
+	last      int     // number of transactions whose endorsement is completed by this endorser
+	lock      sync.Mutex
+}
+
+func initEndorserStats() {
+	endorserStats = &EndorserStats{
+		endorsers: make([]*endorserStat, len(config.Endorsers)),
+	}
+	for i := range endorserStats.endorsers {
+		endorserStats.endorsers[i] = &endorserStat{}
+	}
+}
+
+func (es *EndorserStats) record(endorserIndex int, latency int64, failed bool, timedOut bool) {
+	s := es.endorsers[endorserIndex]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.latencies = append(s.latencies, latency)
+	if failed {
+		s.errors++
+	}
+	if timedOut {
+		s.timeouts++
+	}
+}
+
+// recordLast records that the endorser gives the last response a transaction waits for
+func (es *EndorserStats) recordLast(endorserIndex int) {
+	s := es.endorsers[endorserIndex]
+	s.lock.Lock()
+	s.last++
+	s.lock.Unlock()
+}
+
+// report writes the throughput, latency and errors of each endorser to the report.
+// An endorser which is often the last one to respond holds back the endorsement.
+func (es *EndorserStats) report(duration time.Duration) {
+	reportCh <- fmt.Sprintf("endorser                       responses errors timeouts    TPS p50(ms) p99(ms) avg(ms)   last")
+	for i, e := range config.Endorsers {
+		s := es.endorsers[i]
+		s.lock.Lock()
+		reportCh <- fmt.Sprintf("%-30s %9d %6d %8d %6.2f %7.2f %7.2f %7.2f %6d",
+			e.Address,
+			len(s.latencies),
+			s.errors,
+			s.timeouts,
+			float64(len(s.latencies)-s.errors)/duration.Seconds(),
+			percentileMs(s.latencies, 50),
+			percentileMs(s.latencies, 99),
+			averageLatencyMs(s.latencies),
+			s.last,
+		)
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,195 @@
+package infra
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeEndorserClient responds to each proposal, whose bytes are the txid, with 'respond'
+type fakeEndorserClient struct {
+	respond func(ctx context.Context, txid string) (*peer.ProposalResponse, error)
+}
+
+func (c *fakeEndorserClient) ProcessProposal(ctx context.Context, in *peer.SignedProposal, opts ...grpc.CallOption) (*peer.ProposalResponse, error) {
+	return c.respond(ctx, string(in.ProposalBytes))
+}
+
+func TestEndorserStats(t *testing.T) {
+	defer func(c *Config, l *log.Logger, m map[string]int, tks TimeKeepers, lc chan string, rc chan string, s *Schedule, d chan struct{}, mi *MetricInstance, es *EndorserStats) {
+		config, logger, txid2id, timeKeepers, logCh, reportCh, schedule, doneCh, Metric, endorserStats = c, l, m, tks, lc, rc, s, d, mi, es
+	}(config, logger, txid2id, timeKeepers, logCh, reportCh, schedule, doneCh, Metric, endorserStats)
+
+	logger = log.New()
+	config = &Config{TxNum: 2, EndorserNum: 2, EndorsersPerGroup: 2, ClientPerConnNum: 1, Endorsers: []Node{{Address: "peer0"}, {Address: "peer1"}}}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	reportCh = make(chan string, 100)
+	schedule = &Schedule{unlimited: true}
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+	Metric = NewMetricInstance()
+	initEndorserStats()
+
+	ok := &peer.ProposalResponse{Response: &peer.Response{Status: 200}}
+	// peer0 responds at once but fails tx1, while peer1 is slow and responds to tx1 with a bad status
+	clients := []*fakeEndorserClient{
+		{respond: func(ctx context.Context, txid string) (*peer.ProposalResponse, error) {
+			if txid == "tx1" {
+				return nil, errors.New("connection reset")
+			}
+			return ok, nil
+		}},
+		{respond: func(ctx context.Context, txid string) (*peer.ProposalResponse, error) {
+			time.Sleep(20 * time.Millisecond)
+			if txid == "tx1" {
+				return &peer.ProposalResponse{Response: &peer.Response{Status: 500}}, nil
+			}
+			return ok, nil
+		}},
+	}
+
+	outCh := make(chan *Element, 2)
+	inChs := make([]chan *Element, len(clients))
+	for i, client := range clients {
+		inChs[i] = make(chan *Element, 2)
+		p := &Proposer{endorserIndex: i, client: client, inCh: inChs[i], outCh: outCh, limiter: &RateLimiter{}}
+		p.Start()
+	}
+
+	for _, txid := range []string{"tx0", "tx1"} {
+		element := &Element{Txid: txid, SignedProposal: &peer.SignedProposal{ProposalBytes: []byte(txid)}}
+		for _, inCh := range inChs {
+			inCh <- element
+		}
+	}
+
+	waitFor(t, "responses", func() bool {
+		responses := 0
+		for _, s := range endorserStats.endorsers {
+			s.lock.Lock()
+			responses += len(s.latencies)
+			s.lock.Unlock()
+		}
+		return responses == 4
+	})
+
+	select {
+	case element := <-outCh:
+		if element.Txid != "tx0" {
+			t.Errorf("%s is endorsed, want tx0", element.Txid)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("tx0 is not endorsed")
+	}
+	if Metric.Dropped != 1 {
+		t.Errorf("Dropped = %d, want only tx1 counted once", Metric.Dropped)
+	}
+
+	endorserStats.report(time.Second)
+	<-reportCh
+	tests := []struct {
+		address string
+		errors  int
+		last    int
+	}{
+		{"peer0", 1, 0},
+		{"peer1", 1, 1},
+	}
+	for i, tt := range tests {
+		s := endorserStats.endorsers[i]
+		if s.errors != tt.errors || s.last != tt.last {
+			t.Errorf("%s has %d errors and gives %d last responses, want %d and %d", tt.address, s.errors, s.last, tt.errors, tt.last)
+		}
+		if line := <-reportCh; !strings.HasPrefix(line, tt.address) {
+			t.Errorf("report line %d = %q, want one of %s", i, line, tt.address)
+		}
+	}
+}
+
+func TestProposerProcess(t *testing.T) {
+	defer func(c *Config, l *log.Logger, mi *MetricInstance, es *EndorserStats) {
+		config, logger, Metric, endorserStats = c, l, mi, es
+	}(config, logger, Metric, endorserStats)
+	logger = log.New()
+
+	ok := &peer.ProposalResponse{Response: &peer.Response{Status: 200}}
+	respondAfter := func(d time.Duration, resp *peer.ProposalResponse, err error) *fakeEndorserClient {
+		return &fakeEndorserClient{respond: func(ctx context.Context, txid string) (*peer.ProposalResponse, error) {
+			select {
+			case <-time.After(d):
+				return resp, err
+			case <-ctx.Done():
+				return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+			}
+		}}
+	}
+
+	tests := []struct {
+		name         string
+		timeout      TimeoutConfig
+		primary      *fakeEndorserClient
+		hedge        *fakeEndorserClient
+		wantFrom     int // index of the endorser whose result wins, -1 if failed
+		wantTimedOut bool
+		wantHedged   int32
+	}{
+		{"fast primary", TimeoutConfig{Hedge: 50}, respondAfter(0, ok, nil), respondAfter(0, ok, nil), 0, false, 0},
+		{"slow primary is hedged", TimeoutConfig{Hedge: 50}, respondAfter(200*time.Millisecond, ok, nil), respondAfter(0, ok, nil), 1, false, 1},
+		{"failed hedge waits for the primary", TimeoutConfig{Hedge: 50}, respondAfter(200*time.Millisecond, ok, nil), respondAfter(0, nil, errors.New("unavailable")), 0, false, 1},
+		{"no hedge without threshold", TimeoutConfig{}, respondAfter(100*time.Millisecond, ok, nil), respondAfter(0, ok, nil), 0, false, 0},
+		{"deadline", TimeoutConfig{Endorse: 50}, respondAfter(time.Second, ok, nil), nil, -1, true, 0},
+		{"deadline of both", TimeoutConfig{Endorse: 100, Hedge: 50}, respondAfter(time.Second, ok, nil), respondAfter(time.Second, ok, nil), -1, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{Endorsers: make([]Node, 2), Timeout: tt.timeout}
+			Metric = NewMetricInstance()
+			initEndorserStats()
+
+			p := &Proposer{endorserIndex: 0, client: tt.primary, address: "peer0"}
+			if tt.hedge != nil {
+				p.hedges = []*Proposer{{endorserIndex: 1, client: tt.hedge, address: "peer1"}}
+			}
+
+			result := p.process(&peer.SignedProposal{ProposalBytes: []byte("tx0")})
+			if tt.wantFrom < 0 {
+				if !result.failed() || result.timedOut() != tt.wantTimedOut {
+					t.Errorf("process() = %+v, want a failure timed out: %v", result, tt.wantTimedOut)
+				}
+			} else if result.failed() {
+				t.Errorf("process() = %+v, want a success", result)
+			}
+			if Metric.Hedged != tt.wantHedged {
+				t.Errorf("Hedged = %d, want %d", Metric.Hedged, tt.wantHedged)
+			}
+
+			// The loser keeps running after process returns, so wait for both results to be recorded
+			calls := func(i int) int {
+				s := endorserStats.endorsers[i]
+				s.lock.Lock()
+				defer s.lock.Unlock()
+				return len(s.latencies)
+			}
+			waitFor(t, "every call", func() bool { return calls(0)+calls(1) == 1+int(tt.wantHedged) })
+
+			// The winner is the endorser which has recorded a successful response
+			if tt.wantFrom >= 0 {
+				s := endorserStats.endorsers[tt.wantFrom]
+				if len(s.latencies)-s.errors < 1 {
+					t.Errorf("endorser %d does not give a successful response", tt.wantFrom)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package infra
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Evaluators struct {
+	evaluators []*Evaluator
+}
+
+func NewEvaluators(inCh chan *Element) *Evaluators {
+	evaluatorList := make([]*Evaluator, config.IntegratorNum)
+	for i := 0; i < config.IntegratorNum; i++ {
+		evaluatorList[i] = &Evaluator{
+			inCh: inCh,
+		}
+	}
+
+	return &Evaluators{evaluators: evaluatorList}
+}
+
+// StartAsync starts evaluating responses, and ends the run once every transaction is evaluated or dropped
+func (es *Evaluators) StartAsync() {
+	for _, e := range es.evaluators {
+		goWorker(e.Start)
+	}
+
+	goWorker(waitEvaluated)
+}
+
+// waitEvaluated closes 'observerEndCh' once every transaction is evaluated or dropped,
+// or no transaction is evaluated for a while
+func waitEvaluated() {
+	timeout := time.Duration(config.ObserverTimeout) * time.Second
+	ticker := time.NewTicker(completionCheckInterval)
+	defer ticker.Stop()
+
+	last := int32(0)
+	lastProgress := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			evaluated := atomic.LoadInt32(&Metric.Evaluated)
+			if evaluated+atomic.LoadInt32(&Metric.Dropped) >= int32(config.TxNum) {
+				close(observerEndCh)
+				return
+			}
+
+			if evaluated != last {
+				last = evaluated
+				lastProgress = time.Now()
+			} else if time.Since(lastProgress) > timeout {
+				logger.Warnf("No transaction is evaluated in %v, stop waiting for the remaining transactions", timeout)
+				close(observerEndCh)
+				return
+			}
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+// Evaluator checks the responses of a query against the expectation of its target
+type Evaluator struct {
+	inCh chan *Element
+}
+
+func (e *Evaluator) Start() {
+	for {
+		select {
+		case element := <-e.inCh:
+			matched := verifyResponses(element)
+
+			timeKeepers.keepEvaluatedTime(element.Txid, matched)
+			completeTx(element.Txid)
+
+			Metric.AddEvaluated()
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+func WaitQueryEnd(startTime time.Time, virtualClients *VirtualClients, printWG *sync.WaitGroup) *Summary {
+	<-observerEndCh
+	endTime := time.Now()
+	duration := endTime.Sub(startTime)
+	logger.Infof("Finish evaluating transactions")
+
+	var latencies []int64
+	for _, tk := range timeKeepers.transactions {
+		if tk.ObservedTime != 0 {
+			latencies = append(latencies, tk.ObservedTime-tk.ProposedTime)
+		}
+	}
+
+	reportCh <- fmt.Sprintf("Number of ALL Transactions: %d", config.TxNum)
+	reportCh <- fmt.Sprintf("Number of EVALUATED Transactions: %d", Metric.Evaluated)
+	mismatches.report()
+	reportCh <- fmt.Sprintf("Number of DROPPED Transactions: %d", Metric.Dropped)
+	reportCh <- fmt.Sprintf("Number of TIMED OUT Proposals: %d", Metric.EndorseTimeouts)
+	reportCh <- fmt.Sprintf("Number of HEDGED Proposals: %d", Metric.Hedged)
+	reportCh <- fmt.Sprintf("Duration: %.3fs", float64(duration.Milliseconds())/float64(1e3))
+	reportCh <- fmt.Sprintf("TPS: %f", float64(Metric.Evaluated)*1e9/float64(duration.Nanoseconds()))
+	reportCh <- fmt.Sprintf("Average Latency: %.2fms, P50 Latency: %.2fms, P99 Latency: %.2fms",
+		averageLatencyMs(latencies), percentileMs(latencies, 50), percentileMs(latencies, 99))
+	reportRateLimiters(startTime)
+	endorserStats.report(duration)
+	if virtualClients != nil {
+		virtualClients.report(duration)
+	}
+	reportChannels(duration)
+
+	schedule.reportPhases(startTime, endTime)
+
+	mustWriteTimeSeries(startTime, endTime)
+	reportCh <- fmt.Sprintf("Time series: %s", config.TimeSeriesPath)
+	if config.CheckRWSet {
+		reportCh <- fmt.Sprintf("Read/write sets: %s", config.RWSetPath)
+	}
+
+	reportCh <- fmt.Sprintf("id    endorse(ms)")
+	for i, tk := range timeKeepers.transactions {
+		endorsementDuration := float64(tk.EndorsedTime-tk.ProposedTime) / float64(1e6)
+		if endorsementDuration < 0.0 {
+			endorsementDuration = 0.0
+		}
+		reportCh <- fmt.Sprintf("%-5d %11.2f", i, endorsementDuration)
+	}
+
+	close(doneCh)
+	stopPipeline()
+	rwsetDumper.close()
+
+	// Wait for WriteLogToFile() to return
+	printWG.Wait()
+
+	return summarize(duration)
+}
+
+// Query executes the query benchmark, in which transactions are only endorsed and evaluated
+// An Element (i.e. a transaction) will go through the following channels
+// unsignedCh -> signedCh -> endorsedCh
+func Query() *Summary {
+	Metric = NewMetricInstance()
+	initPipeline()
+	initChannels()
+	initTimeKeepers()
+	schedule = NewSchedule()
+	initRateLimiters()
+	initCompletions()
+	initMismatches()
+	initEndorserStats()
+	initRWSetDumper()
+
+	printWG := &sync.WaitGroup{}
+	go WriteLogToFile(printWG)
+
+	initiator := NewInitiator(unsignedCh)
+	signerInCh, virtualClients := newVirtualClientsIfClosedLoop()
+
+	signers := NewSigners(signerInCh, signedChs)
+	proposers := NewProposers(signedChs, endorsedCh)
+	evaluators := NewEvaluators(endorsedCh)
+
+	proposers.StartAsync()
+	evaluators.StartAsync()
+
+	startTime := startGenerating(initiator, signers, virtualClients)
+
+	return WaitQueryEnd(startTime, virtualClients, printWG)
+}
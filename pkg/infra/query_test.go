@@ -0,0 +1,109 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// proposalResponse builds an endorsement response with the status and payload
+func proposalResponse(status int32, payload string) *peer.ProposalResponse {
+	return &peer.ProposalResponse{Response: &peer.Response{Status: status, Payload: []byte(payload)}}
+}
+
+func TestEvaluator(t *testing.T) {
+	defer func(c *Config, l *log.Logger, m map[string]int, tt []int, tks TimeKeepers, lc chan string, d chan struct{}, mi *MetricInstance, ms *Mismatches) {
+		config, logger, txid2id, txTargets, timeKeepers, logCh, doneCh, Metric, mismatches = c, l, m, tt, tks, lc, d, mi, ms
+	}(config, logger, txid2id, txTargets, timeKeepers, logCh, doneCh, Metric, mismatches)
+
+	logger = log.New()
+	config = &Config{TxNum: 4, Targets: []Target{
+		{Expect: Expectation{Payload: "100"}},
+		{Expect: Expectation{Status: 500}},
+	}}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1, "tx2": 2, "tx3": 3}
+	txTargets = []int{0, 0, 1, 1}
+	initTimeKeepers()
+	logCh = make(chan string, 100)
+	doneCh = make(chan struct{})
+	defer close(doneCh)
+	Metric = NewMetricInstance()
+	initMismatches()
+
+	inCh := make(chan *Element)
+	go (&Evaluator{inCh: inCh}).Start()
+
+	elements := []struct {
+		txid      string
+		responses []*peer.ProposalResponse
+		matched   bool
+	}{
+		{"tx0", []*peer.ProposalResponse{proposalResponse(200, "100"), proposalResponse(200, "100")}, true},
+		{"tx1", []*peer.ProposalResponse{proposalResponse(200, "100"), proposalResponse(200, "99")}, false},
+		{"tx2", []*peer.ProposalResponse{proposalResponse(500, "")}, true},
+		{"tx3", []*peer.ProposalResponse{proposalResponse(200, "")}, false},
+	}
+	for _, e := range elements {
+		inCh <- &Element{Txid: e.txid, Responses: e.responses}
+	}
+	// Make sure the last one is evaluated
+	inCh <- &Element{Txid: "unknown"}
+
+	for i, e := range elements {
+		tk := timeKeepers.transactions[i]
+		if tk.ObservedTime == 0 {
+			t.Errorf("%s is not evaluated", e.txid)
+		}
+		if tk.valid != e.matched {
+			t.Errorf("%s matches the expectation: %v, want %v", e.txid, tk.valid, e.matched)
+		}
+	}
+	if Metric.Mismatched != 2 {
+		t.Errorf("Mismatched = %d, want 2", Metric.Mismatched)
+	}
+}
+
+func TestWaitEvaluated(t *testing.T) {
+	defer func(c *Config, l *log.Logger, e chan struct{}, d chan struct{}, mi *MetricInstance) {
+		config, logger, observerEndCh, doneCh, Metric = c, l, e, d, mi
+	}(config, logger, observerEndCh, doneCh, Metric)
+
+	logger = log.New()
+
+	tests := []struct {
+		name      string
+		evaluated int32
+		dropped   int32
+		timeout   int
+		wantEnd   bool
+	}{
+		{"all evaluated", 3, 0, 10, true},
+		{"the rest are dropped", 2, 1, 10, true},
+		{"some are pending", 2, 0, 10, false},
+		{"no progress before timeout", 2, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{TxNum: 3, ObserverTimeout: tt.timeout}
+			Metric = &MetricInstance{Evaluated: tt.evaluated, Dropped: tt.dropped}
+			observerEndCh = make(chan struct{})
+			doneCh = make(chan struct{})
+			go waitEvaluated()
+			defer close(doneCh)
+
+			select {
+			case <-observerEndCh:
+				if !tt.wantEnd {
+					t.Errorf("the run ends with %d of %d transactions evaluated", tt.evaluated, config.TxNum)
+				}
+			case <-time.After(5 * completionCheckInterval):
+				if tt.wantEnd {
+					t.Errorf("the run does not end")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package infra
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// refillInterval is how often the rate limiter refills its token bucket
+	refillInterval = time.Millisecond
+	// integralStep is the step used to integrate the schedule when computing the requested rate
+	integralStep = 10 * time.Millisecond
+	// bottleneckRatio is the ratio of achieved to requested rate below which tape itself may be the bottleneck
+	bottleneckRatio = 0.95
+)
+
+var (
+	rateLimiters []*RateLimiter
+)
+
+// RateLimiter is a token bucket shared by a group of workers.
+// Tokens are issued in batches according to the time elapsed since the last refill,
+// so that the rate does not drift with the resolution of timers.
+type RateLimiter struct {
+	name     string
+	tokenCh  chan struct{} // the bucket, whose capacity is the burst
+	perTx    float64       // number of tokens consumed by one transaction
+	taken    int64         // number of tokens taken since the beginning of the run
+	lastTake int64         // unix nano of the last time a token was taken
+	done     chan struct{}
+}
+
+// NewRateLimiter creates a token bucket which follows the schedule and allows 'burst' transactions at most,
+// each of which consumes 'perTx' tokens
+func NewRateLimiter(name string, perTx float64) *RateLimiter {
+	rl := &RateLimiter{
+		name:    name,
+		tokenCh: make(chan struct{}, int(float64(config.Burst)*perTx)),
+		perTx:   perTx,
+		done:    doneCh,
+	}
+	rateLimiters = append(rateLimiters, rl)
+	return rl
+}
+
+func initRateLimiters() {
+	rateLimiters = nil
+}
+
+// startRateLimiters starts refilling every token bucket once the run begins,
+// so that the buckets, which start empty, do not fill up while transactions are being generated
+// and let a burst of them through at once
+func startRateLimiters() {
+	for _, rl := range rateLimiters {
+		rl.StartAsync()
+	}
+}
+
+// StartAsync starts refilling the token bucket
+func (rl *RateLimiter) StartAsync() {
+	if schedule.Unlimited() {
+		return
+	}
+	goWorker(rl.refill)
+}
+
+func (rl *RateLimiter) refill() {
+	ticker := time.NewTicker(refillInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	credit := 0.0
+	for {
+		select {
+		case now := <-ticker.C:
+			credit += schedule.Rate() * rl.perTx * now.Sub(last).Seconds()
+			last = now
+
+			n := int(credit)
+			credit -= float64(n)
+			for i := 0; i < n; i++ {
+				select {
+				case rl.tokenCh <- struct{}{}:
+				default:
+					// The bucket is full, so the rest of tokens are discarded
+					i = n
+				}
+			}
+		case <-rl.done:
+			return
+		}
+	}
+}
+
+// Take blocks until a token is available. It returns false if the run ends before that.
+func (rl *RateLimiter) Take() bool {
+	if !schedule.Unlimited() {
+		select {
+		case <-rl.tokenCh:
+		case <-rl.done:
+			return false
+		}
+	}
+	atomic.AddInt64(&rl.taken, 1)
+	atomic.StoreInt64(&rl.lastTake, time.Now().UnixNano())
+	return true
+}
+
+// requestedRate returns the average rate in transactions per second
+// requested by the schedule from 'startTime' to the last time a token was taken
+func (rl *RateLimiter) requestedRate(startTime time.Time) float64 {
+	window := time.Duration(atomic.LoadInt64(&rl.lastTake) - startTime.UnixNano())
+	if window <= 0 {
+		return 0.0
+	}
+
+	requested := 0.0
+	for elapsed := time.Duration(0); elapsed < window; elapsed += integralStep {
+		step := integralStep
+		if elapsed+step > window {
+			step = window - elapsed
+		}
+		requested += schedule.RateAt(elapsed) * step.Seconds()
+	}
+	return requested / window.Seconds()
+}
+
+// achievedRate returns the average rate in transactions per second
+// at which tokens were taken from 'startTime' to the last time a token was taken
+func (rl *RateLimiter) achievedRate(startTime time.Time) float64 {
+	window := time.Duration(atomic.LoadInt64(&rl.lastTake) - startTime.UnixNano())
+	if window <= 0 {
+		return 0.0
+	}
+	return float64(atomic.LoadInt64(&rl.taken)) / rl.perTx / window.Seconds()
+}
+
+// reportRateLimiters writes the achieved versus requested rate of each rate limiter to the report
+func reportRateLimiters(startTime time.Time) {
+	for _, rl := range rateLimiters {
+		achieved := rl.achievedRate(startTime)
+		if schedule.Unlimited() {
+			reportCh <- fmt.Sprintf("%s Rate: requested unlimited, achieved %.2f tx/s", rl.name, achieved)
+			continue
+		}
+
+		requested := rl.requestedRate(startTime)
+		reportCh <- fmt.Sprintf("%s Rate: requested %.2f tx/s, achieved %.2f tx/s", rl.name, requested, achieved)
+		if achieved < requested*bottleneckRatio {
+			logger.Warnf("%s achieved %.2f tx/s, lower than the requested %.2f tx/s: tape itself may be the bottleneck", rl.name, achieved, requested)
+		}
+	}
+}
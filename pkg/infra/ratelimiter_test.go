@@ -0,0 +1,99 @@
+package infra
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	defer func(c *Config, s *Schedule, d chan struct{}, rls []*RateLimiter) {
+		config, schedule, doneCh, rateLimiters = c, s, d, rls
+	}(config, schedule, doneCh, rateLimiters)
+
+	config = &Config{Rate: 1000, Burst: 1000}
+	schedule = NewSchedule()
+	schedule.Start(time.Now())
+	doneCh = make(chan struct{})
+
+	rl := NewRateLimiter("Test", 1)
+	rl.StartAsync()
+	time.Sleep(200 * time.Millisecond)
+	close(doneCh)
+	workers.Wait()
+
+	// 200 tokens are expected, with a wide margin for the scheduler of the test machine
+	if n := len(rl.tokenCh); n < 100 || n > 300 {
+		t.Errorf("%d tokens are refilled in 200ms at 1000 tx/s, want about 200", n)
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	defer func(c *Config, s *Schedule, d chan struct{}, rls []*RateLimiter) {
+		config, schedule, doneCh, rateLimiters = c, s, d, rls
+	}(config, schedule, doneCh, rateLimiters)
+
+	config = &Config{Rate: 10000, Burst: 10}
+	schedule = NewSchedule()
+	schedule.Start(time.Now())
+	doneCh = make(chan struct{})
+
+	// Each transaction takes 3 tokens, so the bucket holds 3 times the burst
+	rl := NewRateLimiter("Test", 3)
+	rl.StartAsync()
+	time.Sleep(50 * time.Millisecond)
+	close(doneCh)
+	workers.Wait()
+
+	if n := len(rl.tokenCh); n != 30 {
+		t.Errorf("%d tokens are in the bucket, want it to be capped at 30", n)
+	}
+	for i := 0; i < 30; i++ {
+		<-rl.tokenCh
+	}
+	// Nothing is taken once the run ends
+	if rl.Take() {
+		t.Errorf("Take() = true after the run ends, with an empty bucket")
+	}
+}
+
+func TestRateLimiterRates(t *testing.T) {
+	defer func(s *Schedule) { schedule = s }(schedule)
+
+	// 100 tx/s for 10 seconds, then ramp from 100 to 300 tx/s in 10 seconds
+	schedule = &Schedule{phases: []Phase{
+		{Shape: "constant", Duration: 10, Rate: 100},
+		{Shape: "ramp", Duration: 10, From: 100, To: 300},
+	}}
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name          string
+		perTx         float64
+		taken         int64
+		window        time.Duration
+		wantRequested float64
+		wantAchieved  float64
+	}{
+		{"nothing taken", 1, 0, 0, 0, 0},
+		{"constant", 1, 500, 10 * time.Second, 100, 50},
+		{"constant and ramp", 1, 3000, 20 * time.Second, 150, 150},
+		{"several tokens per transaction", 2, 3000, 20 * time.Second, 150, 75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := &RateLimiter{perTx: tt.perTx, taken: tt.taken}
+			if tt.window > 0 {
+				rl.lastTake = start.Add(tt.window).UnixNano()
+			}
+			// The schedule is integrated in steps, which undershoots a ramp a little
+			if got := rl.requestedRate(start); math.Abs(got-tt.wantRequested) > 0.1 {
+				t.Errorf("requestedRate() = %f, want %f", got, tt.wantRequested)
+			}
+			if got := rl.achievedRate(start); math.Abs(got-tt.wantAchieved) > 1e-6 {
+				t.Errorf("achievedRate() = %f, want %f", got, tt.wantAchieved)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package infra
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	schedule *Schedule
+)
+
+// Phase is one segment of the load shape declared in the configuration file
+type Phase struct {
+	Name     string `yaml:"name"`     // name of the phase shown in the report
+	Shape    string `yaml:"shape"`    // load shape ['constant', 'ramp', 'step', 'spike', 'sine']
+	Duration int    `yaml:"duration"` // length of the phase in seconds (of each step for 'step')
+
+	Rate int `yaml:"rate"` // 'constant': the rate; 'spike' and 'sine': the base rate
+
+	From int `yaml:"from"` // 'ramp': the rate at the beginning of the phase
+	To   int `yaml:"to"`   // 'ramp': the rate at the end of the phase
+
+	Steps []int `yaml:"steps"` // 'step': rates in order, each of which lasts for Duration seconds
+
+	Peak          int `yaml:"peak"`          // 'spike': the rate during the spike
+	SpikeAt       int `yaml:"spikeAt"`       // 'spike': seconds from the beginning of the phase to the spike
+	SpikeDuration int `yaml:"spikeDuration"` // 'spike': length of the spike in seconds
+
+	Amplitude int `yaml:"amplitude"` // 'sine': the amplitude around the base rate
+	Period    int `yaml:"period"`    // 'sine': the period in seconds
+}
+
+func (p *Phase) valid() error {
+	if p.Duration <= 0 {
+		return errors.Errorf("phase %s: duration %d is not positive", p.Name, p.Duration)
+	}
+
+	switch p.Shape {
+	case "constant", "":
+		if p.Rate < 0 {
+			return errors.Errorf("phase %s: rate %d is negative", p.Name, p.Rate)
+		}
+	case "ramp":
+		if p.From < 0 || p.To < 0 {
+			return errors.Errorf("phase %s: ramp from %d to %d contains a negative rate", p.Name, p.From, p.To)
+		}
+	case "step":
+		if len(p.Steps) == 0 {
+			return errors.Errorf("phase %s: no step is provided", p.Name)
+		}
+		for _, r := range p.Steps {
+			if r < 0 {
+				return errors.Errorf("phase %s: step rate %d is negative", p.Name, r)
+			}
+		}
+	case "spike":
+		if p.Rate < 0 || p.Peak < 0 {
+			return errors.Errorf("phase %s: rate %d or peak %d is negative", p.Name, p.Rate, p.Peak)
+		}
+		if p.SpikeAt < 0 || p.SpikeAt+p.SpikeDuration > p.Duration {
+			return errors.Errorf("phase %s: spike [%d, %d) is out of the phase", p.Name, p.SpikeAt, p.SpikeAt+p.SpikeDuration)
+		}
+	case "sine":
+		if p.Period <= 0 {
+			return errors.Errorf("phase %s: period %d is not positive", p.Name, p.Period)
+		}
+		if p.Amplitude > p.Rate {
+			return errors.Errorf("phase %s: amplitude %d is bigger than the base rate %d", p.Name, p.Amplitude, p.Rate)
+		}
+	default:
+		return errors.Errorf("phase %s: unknown shape %s", p.Name, p.Shape)
+	}
+
+	return nil
+}
+
+// expand splits a 'step' phase into constant phases, one for each step,
+// so that each step is reported separately
+func (p *Phase) expand() []Phase {
+	if p.Shape != "step" {
+		return []Phase{*p}
+	}
+
+	phases := make([]Phase, len(p.Steps))
+	for i, r := range p.Steps {
+		phases[i] = Phase{
+			Name:     fmt.Sprintf("%s#%d", p.Name, i),
+			Shape:    "constant",
+			Duration: p.Duration,
+			Rate:     r,
+		}
+	}
+	return phases
+}
+
+// rateAt returns the expected rate at 'offset' from the beginning of the phase
+func (p *Phase) rateAt(offset time.Duration) float64 {
+	switch p.Shape {
+	case "ramp":
+		progress := offset.Seconds() / float64(p.Duration)
+		return float64(p.From) + float64(p.To-p.From)*progress
+	case "spike":
+		second := int(offset / time.Second)
+		if second >= p.SpikeAt && second < p.SpikeAt+p.SpikeDuration {
+			return float64(p.Peak)
+		}
+		return float64(p.Rate)
+	case "sine":
+		return float64(p.Rate) + float64(p.Amplitude)*math.Sin(2*math.Pi*offset.Seconds()/float64(p.Period))
+	default:
+		return float64(p.Rate)
+	}
+}
+
+// Schedule decides the expected rate of transaction generation at any moment of the run
+type Schedule struct {
+	phases    []Phase
+	unlimited bool  // true if no rate is specified at all
+	startTime int64 // unix nano of the beginning of the run, 0 if not started yet
+}
+
+// NewSchedule builds a schedule from the rate profile in the configuration file.
+// If no rate profile is provided, the whole run is a single constant phase at 'rate'.
+func NewSchedule() *Schedule {
+	s := &Schedule{}
+
+	if isClosedLoop() {
+		// Virtual clients pace themselves in the closed-loop mode
+		s.unlimited = true
+	}
+
+	if len(config.RateProfile) == 0 {
+		s.unlimited = s.unlimited || config.Rate == 0
+		s.phases = []Phase{{
+			Name:     "all",
+			Shape:    "constant",
+			Duration: math.MaxInt32,
+			Rate:     config.Rate,
+		}}
+		return s
+	}
+
+	if s.unlimited {
+		return s
+	}
+
+	for i := range config.RateProfile {
+		if config.RateProfile[i].Name == "" {
+			config.RateProfile[i].Name = fmt.Sprintf("phase%d", i)
+		}
+		s.phases = append(s.phases, config.RateProfile[i].expand()...)
+	}
+	return s
+}
+
+// Start marks the beginning of the run, before which the first phase is in effect
+func (s *Schedule) Start(startTime time.Time) {
+	atomic.StoreInt64(&s.startTime, startTime.UnixNano())
+}
+
+// Elapsed returns the time since the beginning of the run
+func (s *Schedule) Elapsed() time.Duration {
+	startTime := atomic.LoadInt64(&s.startTime)
+	if startTime == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - startTime)
+}
+
+// Unlimited returns true if transactions should be generated as fast as possible
+func (s *Schedule) Unlimited() bool {
+	return s.unlimited
+}
+
+// PhaseAt returns the index of the phase in effect at 'elapsed' since the beginning of the run.
+// The last phase stays in effect after the schedule is exhausted.
+func (s *Schedule) PhaseAt(elapsed time.Duration) int {
+	for i := range s.phases {
+		length := time.Duration(s.phases[i].Duration) * time.Second
+		if elapsed < length {
+			return i
+		}
+		elapsed -= length
+	}
+	return len(s.phases) - 1
+}
+
+// PhaseStart returns the offset of the i-th phase from the beginning of the run
+func (s *Schedule) PhaseStart(i int) time.Duration {
+	var start time.Duration
+	for j := 0; j < i; j++ {
+		start += time.Duration(s.phases[j].Duration) * time.Second
+	}
+	return start
+}
+
+// RateAt returns the expected rate at 'elapsed' since the beginning of the run
+func (s *Schedule) RateAt(elapsed time.Duration) float64 {
+	if s.unlimited {
+		return math.Inf(1)
+	}
+
+	i := s.PhaseAt(elapsed)
+	offset := elapsed - s.PhaseStart(i)
+	if limit := time.Duration(s.phases[i].Duration) * time.Second; offset > limit {
+		// Hold the rate at the end of the last phase
+		offset = limit
+	}
+
+	rate := s.phases[i].rateAt(offset)
+	if rate < 0 {
+		return 0
+	}
+	return rate
+}
+
+// Rate returns the expected rate now
+func (s *Schedule) Rate() float64 {
+	return s.RateAt(s.Elapsed())
+}
+
+// phaseReport summarizes the transactions proposed in one phase
+type phaseReport struct {
+	proposed   int
+	observed   int
+	e2eLatency int64
+}
+
+// reportPhases writes the throughput and latency of each phase to the report
+func (s *Schedule) reportPhases(startTime time.Time, endTime time.Time) {
+	// The closed-loop mode ignores the rate profile, so there is no phase to report
+	if len(config.RateProfile) == 0 || len(s.phases) == 0 {
+		return
+	}
+
+	reports := make([]phaseReport, len(s.phases))
+	for _, tk := range timeKeepers.transactions {
+		if tk.ProposedTime == 0 {
+			continue
+		}
+		r := &reports[s.PhaseAt(time.Duration(tk.ProposedTime-startTime.UnixNano()))]
+		r.proposed++
+		if tk.ObservedTime != 0 {
+			r.observed++
+			r.e2eLatency += tk.ObservedTime - tk.ProposedTime
+		}
+	}
+
+	reportCh <- fmt.Sprintf("phase            shape    duration(s) proposed observed            TPS e2e(ms)")
+	for i, r := range reports {
+		phaseStart := startTime.Add(s.PhaseStart(i))
+		phaseEnd := phaseStart.Add(time.Duration(s.phases[i].Duration) * time.Second)
+		if i == len(s.phases)-1 || phaseEnd.After(endTime) {
+			phaseEnd = endTime
+		}
+		duration := phaseEnd.Sub(phaseStart).Seconds()
+		if duration < 0 {
+			duration = 0
+		}
+
+		tps := 0.0
+		if duration > 0 {
+			tps = float64(r.observed) / duration
+		}
+
+		reportCh <- fmt.Sprintf("%-16s %-8s %11.1f %8d %8d %14.2f %7.2f",
+			s.phases[i].Name,
+			s.phases[i].Shape,
+			duration,
+			r.proposed,
+			r.observed,
+			tps,
+			averageMs(r.e2eLatency, r.observed),
+		)
+	}
+}
@@ -0,0 +1,178 @@
+package infra
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPhaseValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase Phase
+		valid bool
+	}{
+		{"constant", Phase{Duration: 10, Rate: 100}, true},
+		{"default shape", Phase{Duration: 10}, true},
+		{"zero duration", Phase{Shape: "constant", Rate: 100}, false},
+		{"negative rate", Phase{Duration: 10, Rate: -1}, false},
+		{"ramp", Phase{Shape: "ramp", Duration: 10, From: 100, To: 0}, true},
+		{"ramp to negative", Phase{Shape: "ramp", Duration: 10, From: 100, To: -1}, false},
+		{"step", Phase{Shape: "step", Duration: 10, Steps: []int{100, 200}}, true},
+		{"no step", Phase{Shape: "step", Duration: 10}, false},
+		{"negative step", Phase{Shape: "step", Duration: 10, Steps: []int{100, -1}}, false},
+		{"spike", Phase{Shape: "spike", Duration: 10, Rate: 100, Peak: 500, SpikeAt: 5, SpikeDuration: 5}, true},
+		{"spike out of phase", Phase{Shape: "spike", Duration: 10, Rate: 100, Peak: 500, SpikeAt: 8, SpikeDuration: 5}, false},
+		{"negative spike", Phase{Shape: "spike", Duration: 10, Rate: 100, Peak: 500, SpikeAt: -1, SpikeDuration: 5}, false},
+		{"sine", Phase{Shape: "sine", Duration: 10, Rate: 100, Amplitude: 100, Period: 5}, true},
+		{"sine without period", Phase{Shape: "sine", Duration: 10, Rate: 100, Amplitude: 50}, false},
+		{"sine below zero", Phase{Shape: "sine", Duration: 10, Rate: 100, Amplitude: 101, Period: 5}, false},
+		{"unknown shape", Phase{Shape: "square", Duration: 10}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.phase.valid()
+			if tt.valid && err != nil {
+				t.Errorf("valid() = %v, want nil", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("valid() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestPhaseRateAt(t *testing.T) {
+	tests := []struct {
+		name   string
+		phase  Phase
+		offset time.Duration
+		want   float64
+	}{
+		{"constant", Phase{Shape: "constant", Duration: 10, Rate: 100}, 3 * time.Second, 100},
+		{"ramp start", Phase{Shape: "ramp", Duration: 10, From: 100, To: 200}, 0, 100},
+		{"ramp middle", Phase{Shape: "ramp", Duration: 10, From: 100, To: 200}, 5 * time.Second, 150},
+		{"ramp down", Phase{Shape: "ramp", Duration: 10, From: 200, To: 100}, 10 * time.Second, 100},
+		{"before spike", Phase{Shape: "spike", Duration: 10, Rate: 100, Peak: 500, SpikeAt: 5, SpikeDuration: 2}, 4 * time.Second, 100},
+		{"spike", Phase{Shape: "spike", Duration: 10, Rate: 100, Peak: 500, SpikeAt: 5, SpikeDuration: 2}, 6500 * time.Millisecond, 500},
+		{"after spike", Phase{Shape: "spike", Duration: 10, Rate: 100, Peak: 500, SpikeAt: 5, SpikeDuration: 2}, 7 * time.Second, 100},
+		{"sine base", Phase{Shape: "sine", Duration: 10, Rate: 100, Amplitude: 50, Period: 4}, 0, 100},
+		{"sine crest", Phase{Shape: "sine", Duration: 10, Rate: 100, Amplitude: 50, Period: 4}, time.Second, 150},
+		{"sine trough", Phase{Shape: "sine", Duration: 10, Rate: 100, Amplitude: 50, Period: 4}, 3 * time.Second, 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.phase.rateAt(tt.offset); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("rateAt(%v) = %f, want %f", tt.offset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleRateAt(t *testing.T) {
+	s := &Schedule{phases: []Phase{
+		{Name: "warm", Shape: "constant", Duration: 10, Rate: 100},
+		{Name: "ramp", Shape: "ramp", Duration: 10, From: 100, To: 300},
+		{Name: "down", Shape: "ramp", Duration: 10, From: 100, To: -100},
+	}}
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    float64
+	}{
+		{"first phase", 5 * time.Second, 100},
+		{"second phase start", 10 * time.Second, 100},
+		{"second phase middle", 15 * time.Second, 200},
+		{"negative rate is clamped", 28 * time.Second, 0},
+		{"last phase is held", time.Minute, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.RateAt(tt.elapsed); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("RateAt(%v) = %f, want %f", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+
+	held := &Schedule{phases: []Phase{{Shape: "ramp", Duration: 10, From: 100, To: 200}}}
+	if got := held.RateAt(time.Minute); got != 200 {
+		t.Errorf("RateAt after the schedule = %f, want the rate at the end of the last phase 200", got)
+	}
+
+	unlimited := &Schedule{unlimited: true}
+	if got := unlimited.RateAt(time.Second); !math.IsInf(got, 1) {
+		t.Errorf("RateAt of an unlimited schedule = %f, want +Inf", got)
+	}
+}
+
+func TestNewSchedule(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+
+	config = &Config{RateProfile: []Phase{
+		{Shape: "constant", Duration: 5, Rate: 100},
+		{Name: "stairs", Shape: "step", Duration: 2, Steps: []int{200, 300}},
+	}}
+	s := NewSchedule()
+
+	names := []string{"phase0", "stairs#0", "stairs#1"}
+	if len(s.phases) != len(names) {
+		t.Fatalf("NewSchedule() has %d phases, want %d", len(s.phases), len(names))
+	}
+	for i, name := range names {
+		if s.phases[i].Name != name {
+			t.Errorf("phase %d is named %s, want %s", i, s.phases[i].Name, name)
+		}
+	}
+	if got := s.RateAt(6 * time.Second); got != 200 {
+		t.Errorf("RateAt(6s) = %f, want the first step 200", got)
+	}
+	if got := s.PhaseAt(7 * time.Second); got != 2 {
+		t.Errorf("PhaseAt(7s) = %d, want the second step 2", got)
+	}
+
+	config = &Config{}
+	if s := NewSchedule(); !s.Unlimited() {
+		t.Errorf("NewSchedule() without rate and profile is limited, want unlimited")
+	}
+}
+
+func TestReportPhases(t *testing.T) {
+	defer func(c *Config, tks TimeKeepers, rc chan string) {
+		config, timeKeepers, reportCh = c, tks, rc
+	}(config, timeKeepers, reportCh)
+
+	profile := []Phase{
+		{Name: "low", Shape: "constant", Duration: 10, Rate: 100},
+		{Name: "high", Shape: "constant", Duration: 10, Rate: 200},
+	}
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name   string
+		config *Config
+		lines  int // header included
+	}{
+		{"rate profile", &Config{TxNum: 2, RateProfile: profile}, 3},
+		{"closed loop ignores the rate profile", &Config{TxNum: 2, RateProfile: profile, ClosedLoop: ClosedLoopConfig{Clients: 4}}, 0},
+		{"constant rate", &Config{TxNum: 2, Rate: 100}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = tt.config
+			initTimeKeepers()
+			// One transaction is proposed in each phase
+			timeKeepers.transactions[0].ProposedTime = start.Add(time.Second).UnixNano()
+			timeKeepers.transactions[1].ProposedTime = start.Add(15 * time.Second).UnixNano()
+			reportCh = make(chan string, 10)
+
+			NewSchedule().reportPhases(start, start.Add(20*time.Second))
+			if len(reportCh) != tt.lines {
+				t.Errorf("%d lines are reported, want %d", len(reportCh), tt.lines)
+			}
+		})
+	}
+}
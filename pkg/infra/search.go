@@ -0,0 +1,212 @@
+package infra
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SearchConfig configures the search for the maximum sustainable rate
+type SearchConfig struct {
+	MinRate       int     `yaml:"minRate"`       // rate of the first trial
+	MaxRate       int     `yaml:"maxRate"`       // the highest rate to try
+	TrialDuration int     `yaml:"trialDuration"` // seconds of transactions generated in each trial
+	LatencySLO    float64 `yaml:"latencySLO"`    // maximum p99 end-to-end latency in millisecond
+	TrackingRatio float64 `yaml:"trackingRatio"` // minimum ratio of achieved to offered TPS
+	Precision     int     `yaml:"precision"`     // stop when passing and failing rates are closer than this
+	Interval      int     `yaml:"interval"`      // seconds to wait between trials
+}
+
+// configured returns true if any of the bounds of the search is given
+func (s *SearchConfig) configured() bool {
+	return s.MinRate != 0 || s.MaxRate != 0 || s.LatencySLO != 0
+}
+
+// valid checks the search only if it is configured, since only 'tape search' uses it
+func (s *SearchConfig) valid(errs *validationError) {
+	if !s.configured() {
+		return
+	}
+
+	if s.MinRate <= 0 || s.MaxRate < s.MinRate {
+		errs.addf("search", "0 < minRate (%d) <= maxRate (%d) is required", s.MinRate, s.MaxRate)
+	}
+
+	if s.LatencySLO <= 0 {
+		errs.addf("search.latencySLO", "%f is not positive", s.LatencySLO)
+	}
+
+	if s.TrialDuration < 0 || s.Interval < 0 {
+		errs.addf("search", "trial duration %d and interval %d must not be negative", s.TrialDuration, s.Interval)
+	}
+
+	if s.TrialDuration == 0 {
+		s.TrialDuration = 30
+	}
+
+	if s.TrackingRatio <= 0 {
+		s.TrackingRatio = 0.9
+	}
+
+	if s.Precision < 1 {
+		s.Precision = 1
+	}
+}
+
+// Trial is the result of running at one offered rate
+type Trial struct {
+	Rate    int
+	Summary *Summary
+	Passed  bool
+	Reason  string
+}
+
+// Search runs short trials at increasing rates, first exponentially then by bisection,
+// until it finds the maximum rate at which the network sustains the SLO
+func Search(c *Config, l *log.Logger) {
+	config = c
+	logger = l
+
+	// The search is validated with the rest of the config
+	if !c.Search.configured() {
+		logger.Fatalf("Search requires minRate, maxRate and latencySLO in 'search' of the config")
+	}
+
+	// Every trial connects to the same nodes, so the TLS handshakes are checked once
+	mustCheckTLS()
+
+	var trials []*Trial
+	run := func(rate int) bool {
+		if len(trials) > 0 {
+			// Let the network drain the transactions of the previous trial
+			time.Sleep(time.Duration(c.Search.Interval) * time.Second)
+		}
+		trial := runTrial(c, rate, len(trials))
+		trials = append(trials, trial)
+		logger.Infof("Trial %d at %d tx/s: %s", len(trials)-1, rate, trial.Reason)
+		return trial.Passed
+	}
+
+	// Double the rate until a trial fails
+	passed, failed := 0, 0
+	for rate := c.Search.MinRate; ; rate *= 2 {
+		if rate > c.Search.MaxRate {
+			rate = c.Search.MaxRate
+		}
+		if run(rate) {
+			passed = rate
+		} else {
+			failed = rate
+			break
+		}
+		if rate == c.Search.MaxRate {
+			break
+		}
+	}
+
+	// Bisect between the highest passing rate and the lowest failing rate
+	if passed > 0 && failed > 0 {
+		for failed-passed > c.Search.Precision {
+			mid := (passed + failed) / 2
+			if run(mid) {
+				passed = mid
+			} else {
+				failed = mid
+			}
+		}
+	}
+
+	reportSearch(c, trials, passed)
+}
+
+// runTrial runs the end-to-end benchmark at a constant rate
+func runTrial(c *Config, rate int, index int) *Trial {
+	trialConfig := *c
+	trialConfig.Rate = rate
+	trialConfig.RateProfile = nil
+	trialConfig.ClosedLoop = ClosedLoopConfig{}
+	trialConfig.TxNum = rate * c.Search.TrialDuration
+	if trialConfig.Burst < rate {
+		trialConfig.Burst = rate
+	}
+	trialConfig.LogPath = trialPath(c.LogPath, index)
+	trialConfig.ReportPath = trialPath(c.ReportPath, index)
+	trialConfig.TimeSeriesPath = trialPath(c.TimeSeriesPath, index)
+	trialConfig.RWSetPath = trialPath(c.RWSetPath, index)
+	trialConfig.BlockStatsPath = trialPath(c.BlockStatsPath, index)
+	trialConfig.ConflictPath = trialPath(c.ConflictPath, index)
+
+	config = &trialConfig
+	txid2id = make(map[string]int)
+	summary := runBenchmark()
+
+	trial := &Trial{
+		Rate:    rate,
+		Summary: summary,
+		Passed:  true,
+	}
+
+	tracking := summary.CommitTPS / float64(rate)
+	switch {
+	case summary.Observed < trialConfig.TxNum:
+		trial.Passed = false
+		trial.Reason = fmt.Sprintf("only %d of %d transactions are observed", summary.Observed, trialConfig.TxNum)
+	case summary.P99Latency > c.Search.LatencySLO:
+		trial.Passed = false
+		trial.Reason = fmt.Sprintf("p99 latency %.2fms exceeds SLO %.2fms", summary.P99Latency, c.Search.LatencySLO)
+	case tracking < c.Search.TrackingRatio:
+		trial.Passed = false
+		trial.Reason = fmt.Sprintf("achieved %.2f tx/s is only %.1f%% of offered", summary.CommitTPS, tracking*100)
+	default:
+		trial.Reason = fmt.Sprintf("achieved %.2f tx/s with p99 latency %.2fms", summary.CommitTPS, summary.P99Latency)
+	}
+
+	return trial
+}
+
+// trialPath inserts the index of the trial before the extension of path
+func trialPath(path string, index int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_trial%d%s", strings.TrimSuffix(path, ext), index, ext)
+}
+
+// reportSearch prints the measured curve and the maximum sustainable rate,
+// and writes them to the report file
+func reportSearch(c *Config, trials []*Trial, maxRate int) {
+	var lines []string
+	lines = append(lines, "trial offered(tx/s) achieved(tx/s) p99(ms) result")
+	for i, t := range trials {
+		result := "PASS"
+		if !t.Passed {
+			result = "FAIL: " + t.Reason
+		}
+		lines = append(lines, fmt.Sprintf("%-5d %13d %14.2f %7.2f %s",
+			i,
+			t.Rate,
+			t.Summary.CommitTPS,
+			t.Summary.P99Latency,
+			result,
+		))
+	}
+
+	if maxRate > 0 {
+		lines = append(lines, fmt.Sprintf("Maximum Sustainable Rate: %d tx/s", maxRate))
+	} else {
+		lines = append(lines, fmt.Sprintf("Maximum Sustainable Rate: below %d tx/s", c.Search.MinRate))
+	}
+
+	reportFile, err := os.Create(c.ReportPath)
+	if err != nil {
+		logger.Fatalf("Failed to create report file %s: %v\n", c.ReportPath, err)
+	}
+	defer reportFile.Close()
+
+	for _, line := range lines {
+		fmt.Println(line)
+		reportFile.WriteString(line + "\n")
+	}
+}
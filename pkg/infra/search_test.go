@@ -0,0 +1,67 @@
+package infra
+
+import "testing"
+
+func TestTrialPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		index int
+		want  string
+	}{
+		{"report.txt", 0, "report_trial0.txt"},
+		{"/tmp/tape/log.transactions", 3, "/tmp/tape/log_trial3.transactions"},
+		{"timeseries", 12, "timeseries_trial12"},
+		{"./out.v1/ts.csv", 1, "./out.v1/ts_trial1.csv"},
+	}
+
+	for _, tt := range tests {
+		if got := trialPath(tt.path, tt.index); got != tt.want {
+			t.Errorf("trialPath(%q, %d) = %q, want %q", tt.path, tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestSearchConfigValid(t *testing.T) {
+	tests := []struct {
+		name     string
+		search   SearchConfig
+		want     SearchConfig
+		problems int
+	}{
+		{
+			name:   "not configured",
+			search: SearchConfig{},
+			want:   SearchConfig{},
+		},
+		{
+			name:   "defaults",
+			search: SearchConfig{MinRate: 100, MaxRate: 100, LatencySLO: 500},
+			want:   SearchConfig{MinRate: 100, MaxRate: 100, LatencySLO: 500, TrialDuration: 30, TrackingRatio: 0.9, Precision: 1},
+		},
+		{
+			name:   "values given in the configuration file are kept",
+			search: SearchConfig{MinRate: 10, MaxRate: 1000, LatencySLO: 500, TrialDuration: 5, TrackingRatio: 0.5, Precision: 20, Interval: 3},
+			want:   SearchConfig{MinRate: 10, MaxRate: 1000, LatencySLO: 500, TrialDuration: 5, TrackingRatio: 0.5, Precision: 20, Interval: 3},
+		},
+		{
+			name:     "every problem is reported",
+			search:   SearchConfig{MinRate: 100, MaxRate: 10, Interval: -1},
+			want:     SearchConfig{MinRate: 100, MaxRate: 10, Interval: -1, TrialDuration: 30, TrackingRatio: 0.9, Precision: 1},
+			problems: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := &validationError{}
+			s := tt.search
+			s.valid(errs)
+			if s != tt.want {
+				t.Errorf("valid() = %+v, want %+v", s, tt.want)
+			}
+			if len(errs.problems) != tt.problems {
+				t.Errorf("problems = %q, want %d of them", errs.problems, tt.problems)
+			}
+		})
+	}
+}
@@ -22,7 +22,7 @@ func NewSigners(inCh chan *Element, outCh []chan *Element) *Signers {
 
 func (ss *Signers) StartAsync() {
 	for _, signer := range ss.Signers {
-		go signer.Start()
+		goWorker(signer.Start)
 	}
 }
 
@@ -34,8 +34,6 @@ type Signer struct {
 // Start collects an unsigned transactions from the 'raw' channel,
 // sign it, then send it to the 'signed' channel of each endorser
 func (s *Signer) Start() {
-	endorsersPerGroup := int(len(s.outCh) / config.EndorserGroupNum)
-
 	for {
 		select {
 		case e := <-s.inCh:
@@ -47,10 +45,14 @@ func (s *Signer) Start() {
 
 			// Randomly select a groupIndex of endorsers to endorse the transaction
 			groupIndex := rand.Intn(config.EndorserGroupNum)
-			endorserStartIndex := int(config.EndorserGroupNum * groupIndex)
-			endorserEndIndex := endorserStartIndex + endorsersPerGroup
+			endorserStartIndex := config.EndorsersPerGroup * groupIndex
+			endorserEndIndex := endorserStartIndex + config.EndorsersPerGroup
 			for i := endorserStartIndex; i < endorserEndIndex; i++ {
-				s.outCh[i] <- e
+				select {
+				case s.outCh[i] <- e:
+				case <-doneCh:
+					return
+				}
 			}
 
 		case <-doneCh:
@@ -0,0 +1,165 @@
+package infra
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Target is a chaincode on a channel which transactions are sent to
+type Target struct {
+	Channel   string `yaml:"channel"`   // name of the channel
+	Chaincode string `yaml:"chaincode"` // chaincode name
+	Version   string `yaml:"version"`   // chaincode version
+	TxType    string `yaml:"txType"`    // transaction type ['put', 'conflict'], 'txType' by default
+	Weight    int    `yaml:"weight"`    // share of transactions relative to the other targets, 1 by default
+
+	Transient map[string]string `yaml:"transient"` // transient data passed to the chaincode, 'transient' by default; "$random" is replaced per transaction
+	Expect    Expectation       `yaml:"expect"`    // expected endorsement responses
+}
+
+// valid records the problems of the target, whose fields are prefixed with 'prefix' in the config
+func (t *Target) valid(prefix string, errs *validationError) {
+	if t.Channel == "" {
+		errs.addf(prefix+"channel", "not provided")
+	}
+
+	if t.Chaincode == "" {
+		errs.addf(prefix+"chaincode", "not provided")
+	}
+
+	switch t.TxType {
+	case "put", "conflict":
+	case "":
+		errs.addf(prefix+"txType", "not provided, must be 'put' or 'conflict'")
+	default:
+		errs.addf(prefix+"txType", "unknown transaction type %q, must be 'put' or 'conflict'", t.TxType)
+	}
+
+	if t.Weight < 0 {
+		errs.addf(prefix+"weight", "%d is negative", t.Weight)
+	}
+
+	errs.add(prefix+"expect", t.Expect.valid())
+}
+
+// mustLoadTargets falls back to the single channel and chaincode if no target is provided,
+// and collects the channels of all targets
+func (c *Config) mustLoadTargets() {
+	c.implicitTarget = len(c.Targets) == 0
+	if c.implicitTarget {
+		c.Targets = []Target{{
+			Channel:   c.Channel,
+			Chaincode: c.Chaincode,
+			Version:   c.Version,
+			TxType:    c.TxType,
+			Weight:    1,
+			Transient: c.Transient,
+			Expect:    c.Expect,
+		}}
+	}
+
+	c.Channels = nil
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if t.TxType == "" {
+			t.TxType = c.TxType
+		}
+		if t.Transient == nil {
+			t.Transient = c.Transient
+		}
+		if t.Weight == 0 {
+			t.Weight = 1
+		}
+		if channelIndexOf(c.Channels, t.Channel) < 0 {
+			c.Channels = append(c.Channels, t.Channel)
+		}
+	}
+}
+
+// channelIndexOf returns the index of 'channel' in 'channels', or -1 if not found
+func channelIndexOf(channels []string, channel string) int {
+	for i, ch := range channels {
+		if ch == channel {
+			return i
+		}
+	}
+	return -1
+}
+
+// generateTargetList decides the target of every transaction at random according to the weights
+func generateTargetList() []int {
+	total := 0
+	for _, t := range config.Targets {
+		total += t.Weight
+	}
+
+	targetList := make([]int, config.TxNum)
+	for i := range targetList {
+		r := rand.Intn(total)
+		for j, t := range config.Targets {
+			if r < t.Weight {
+				targetList[i] = j
+				break
+			}
+			r -= t.Weight
+		}
+	}
+	return targetList
+}
+
+// channelReport summarizes the transactions sent to one channel
+type channelReport struct {
+	name      string
+	submitted int
+	observed  int
+	valid     int
+	dropped   int
+	latencies []int64
+}
+
+// reportChannels writes the throughput and latency of each channel and of all channels to the report
+func reportChannels(duration time.Duration) {
+	if len(config.Channels) < 2 {
+		return
+	}
+
+	reports := make([]*channelReport, len(config.Channels)+1)
+	for i, ch := range config.Channels {
+		reports[i] = &channelReport{name: ch}
+	}
+	all := &channelReport{name: "all"}
+	reports[len(config.Channels)] = all
+
+	for id, tk := range timeKeepers.transactions {
+		channelIndex := channelIndexOf(config.Channels, config.Targets[txTargets[id]].Channel)
+		for _, r := range []*channelReport{reports[channelIndex], all} {
+			r.submitted++
+			if atomic.LoadInt32(&tk.dropped) == 1 {
+				r.dropped++
+			}
+			if tk.ObservedTime != 0 {
+				r.observed++
+				r.latencies = append(r.latencies, tk.ObservedTime-tk.ProposedTime)
+				if tk.valid {
+					r.valid++
+				}
+			}
+		}
+	}
+
+	reportCh <- fmt.Sprintf("channel          submitted observed    valid  dropped            TPS e2e-avg(ms) e2e-p99(ms)")
+	for _, r := range reports {
+		reportCh <- fmt.Sprintf("%-16s %9d %8d %8d %8d %14.2f %11.2f %11.2f",
+			r.name,
+			r.submitted,
+			r.observed,
+			r.valid,
+			r.dropped,
+			float64(r.observed)/duration.Seconds(),
+			averageLatencyMs(r.latencies),
+			percentileMs(r.latencies, 99),
+		)
+	}
+}
@@ -0,0 +1,54 @@
+package infra
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestGenerateTargetList(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+
+	tests := []struct {
+		name    string
+		weights []int
+		txNum   int
+	}{
+		{"single target", []int{1}, 100},
+		{"even weights", []int{1, 1}, 10000},
+		{"uneven weights", []int{3, 1}, 10000},
+		{"target without weight", []int{2, 0, 1, 1}, 10000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rand.Seed(1)
+			config = &Config{TxNum: tt.txNum}
+			total := 0
+			for _, w := range tt.weights {
+				config.Targets = append(config.Targets, Target{Weight: w})
+				total += w
+			}
+
+			targetList := generateTargetList()
+			if len(targetList) != tt.txNum {
+				t.Fatalf("%d targets, want one for each of %d transactions", len(targetList), tt.txNum)
+			}
+
+			counts := make([]int, len(tt.weights))
+			for _, target := range targetList {
+				if target < 0 || target >= len(tt.weights) {
+					t.Fatalf("target %d is out of range [0, %d)", target, len(tt.weights))
+				}
+				counts[target]++
+			}
+
+			for i, w := range tt.weights {
+				expected := float64(tt.txNum) * float64(w) / float64(total)
+				if w == 0 && counts[i] != 0 || math.Abs(float64(counts[i])-expected) > 0.05*float64(tt.txNum) {
+					t.Errorf("target %d with weight %d gets %d transactions, want about %.0f", i, w, counts[i], expected)
+				}
+			}
+		})
+	}
+}
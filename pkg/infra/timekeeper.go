@@ -2,6 +2,7 @@ package infra
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/GwanWingYan/fabric-protos-go/peer"
@@ -16,10 +17,16 @@ type TimeKeepers struct {
 }
 
 type TimeKeeper struct {
-	ProposedTime  int64
-	EndorsedTime  int64
-	BroadcastTime int64
-	ObservedTime  int64
+	ProposedTime   int64
+	EndorsedTime   int64
+	BroadcastTime  int64
+	OrderedTime    int64   // when the orderer acknowledges the transaction
+	ordererIndex   int     // the orderer acknowledging the transaction
+	ObservedTime   int64   // when the transaction is observed on a quorum of committers, or evaluated in the query mode
+	valid          bool    // true if the transaction is observed as valid, or its responses meet the expectation
+	CommittedTimes []int64 // when the transaction is observed on each committer
+	dropped        int32   // 1 if the transaction never reaches the orderer
+	rejected       int32   // 1 if the orderer does not accept the transaction
 }
 
 func initTimeKeepers() {
@@ -27,7 +34,9 @@ func initTimeKeepers() {
 		transactions: make([]*TimeKeeper, config.TxNum),
 	}
 	for i := range timeKeepers.transactions {
-		timeKeepers.transactions[i] = &TimeKeeper{}
+		timeKeepers.transactions[i] = &TimeKeeper{
+			CommittedTimes: make([]int64, len(config.Committers)),
+		}
 	}
 }
 
@@ -39,7 +48,12 @@ func (tks *TimeKeepers) keepProposedTime(
 ) {
 	proposedTime := time.Now().UnixNano()
 
-	id := txid2id[txid]
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
 	logCh <- fmt.Sprintf("%-10s %d %4d %s %d %d %d", "Proposed", proposedTime, id, txid, endorserIndex, connIndex, clientIndex)
 
 	timeKeepers.transactions[id].ProposedTime = proposedTime
@@ -53,7 +67,12 @@ func (tks *TimeKeepers) keepEndorsedTime(
 ) {
 	endorsedTime := time.Now().UnixNano()
 
-	id := txid2id[txid]
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
 	logCh <- fmt.Sprintf("%-10s %d %4d %s %d %d %d", "Endorsed", endorsedTime, id, txid, endorserIndex, connIndex, clientIndex)
 
 	timeKeepers.transactions[id].EndorsedTime = endorsedTime
@@ -65,20 +84,144 @@ func (tks *TimeKeepers) keepBroadcastTime(
 ) {
 	broadcastTime := time.Now().UnixNano()
 
-	id := txid2id[txid]
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
 	logCh <- fmt.Sprintf("%-10s %d %4d %s %d", "Broadcast", broadcastTime, id, txid, broadcasterIndex)
 
 	timeKeepers.transactions[id].BroadcastTime = broadcastTime
 }
 
+func (tks *TimeKeepers) keepOrderedTime(
+	txid string,
+	ordererIndex int,
+) {
+	orderedTime := time.Now().UnixNano()
+
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
+	logCh <- fmt.Sprintf("%-10s %d %4d %s %d", "Ordered", orderedTime, id, txid, ordererIndex)
+
+	timeKeepers.transactions[id].ordererIndex = ordererIndex
+	timeKeepers.transactions[id].OrderedTime = orderedTime
+}
+
 func (tks *TimeKeepers) keepObservedTime(
 	txid string,
 	validationCode peer.TxValidationCode,
 ) {
 	observedTime := time.Now().UnixNano()
 
-	id := txid2id[txid]
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
 	logCh <- fmt.Sprintf("%-10s %d %4d %s %s", "Observed", observedTime, id, txid, validationCode)
 
+	timeKeepers.transactions[id].valid = validationCode == peer.TxValidationCode_VALID
 	timeKeepers.transactions[id].ObservedTime = observedTime
 }
+
+func (tks *TimeKeepers) keepEvaluatedTime(
+	txid string,
+	matched bool,
+) {
+	evaluatedTime := time.Now().UnixNano()
+
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
+	logCh <- fmt.Sprintf("%-10s %d %4d %s %t", "Evaluated", evaluatedTime, id, txid, matched)
+
+	timeKeepers.transactions[id].valid = matched
+	timeKeepers.transactions[id].ObservedTime = evaluatedTime
+}
+
+func (tks *TimeKeepers) keepCommittedTime(
+	txid string,
+	committerIndex int,
+	committedTime int64,
+) {
+	id, ok := txid2id[txid]
+	if !ok {
+		// Not a transaction generated in this run
+		return
+	}
+
+	logCh <- fmt.Sprintf("%-10s %d %4d %s %d", "Committed", committedTime, id, txid, committerIndex)
+
+	timeKeepers.transactions[id].CommittedTimes[committerIndex] = committedTime
+}
+
+// isCommitted returns true if the transaction has been observed on the committer
+func (tks *TimeKeepers) isCommitted(txid string, committerIndex int) bool {
+	id, ok := txid2id[txid]
+	if !ok {
+		return false
+	}
+	return timeKeepers.transactions[id].CommittedTimes[committerIndex] != 0
+}
+
+// keepDropped records that the transaction will never reach the orderer.
+// The transaction is counted only once, even if it fails on more than one endorser.
+func (tks *TimeKeepers) keepDropped(txid string, reason string) {
+	id, ok := txid2id[txid]
+	if !ok {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&timeKeepers.transactions[id].dropped, 0, 1) {
+		return
+	}
+
+	logCh <- fmt.Sprintf("%-10s %d %4d %s %s", "Dropped", time.Now().UnixNano(), id, txid, reason)
+	Metric.AddDropped()
+}
+
+// keepRejected records that the orderer does not accept the transaction with 'status'
+func (tks *TimeKeepers) keepRejected(txid string, status string) {
+	id, ok := txid2id[txid]
+	if !ok {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&timeKeepers.transactions[id].rejected, 0, 1) {
+		return
+	}
+
+	logCh <- fmt.Sprintf("%-10s %d %4d %s %s", "Rejected", time.Now().UnixNano(), id, txid, status)
+	Metric.AddRejected()
+}
+
+// reportLostTransactions lists the transactions which are sent to the orderer
+// but not observed before the run ends
+func reportLostTransactions() {
+	txids := make([]string, len(timeKeepers.transactions))
+	for txid, id := range txid2id {
+		txids[id] = txid
+	}
+
+	var lost []int
+	for i, tk := range timeKeepers.transactions {
+		if tk.BroadcastTime != 0 && tk.ObservedTime == 0 && atomic.LoadInt32(&tk.dropped) == 0 && atomic.LoadInt32(&tk.rejected) == 0 {
+			lost = append(lost, i)
+		}
+	}
+
+	reportCh <- fmt.Sprintf("Number of LOST Transactions: %d", len(lost))
+	for _, i := range lost {
+		reportCh <- fmt.Sprintf("    Lost: %d %s", i, txids[i])
+	}
+}
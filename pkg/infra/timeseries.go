@@ -0,0 +1,135 @@
+package infra
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bucket collects the transactions which reach each pipeline stage in one second
+type bucket struct {
+	proposed  int
+	endorsed  int
+	broadcast int
+	ordered   int
+	observed  int
+
+	endorsementLatency int64 // sum of endorsement latency of transactions endorsed in this second
+	integrationLatency int64 // sum of integration latency of transactions broadcast in this second
+	ackLatency         int64 // sum of broadcast-ack latency of transactions acknowledged in this second
+	commitLatency      int64 // sum of ack-to-commit latency of transactions observed in this second
+	committed          int   // number of transactions observed in this second which are also acknowledged
+	e2eLatency         int64 // sum of end-to-end latency of transactions observed in this second
+}
+
+// bucketIndex returns the index of the bucket which timestamp t falls in,
+// or -1 if t is not recorded
+func bucketIndex(t int64, startTime time.Time) int {
+	if t == 0 {
+		return -1
+	}
+	d := t - startTime.UnixNano()
+	if d < 0 {
+		return 0
+	}
+	return int(d / int64(time.Second))
+}
+
+// collectBuckets divides the lifecycle of all transactions into per-second buckets
+func collectBuckets(startTime time.Time, endTime time.Time) []*bucket {
+	buckets := make([]*bucket, int(endTime.Sub(startTime)/time.Second)+1)
+	for i := range buckets {
+		buckets[i] = &bucket{}
+	}
+
+	get := func(t int64) *bucket {
+		i := bucketIndex(t, startTime)
+		if i < 0 || i >= len(buckets) {
+			return nil
+		}
+		return buckets[i]
+	}
+
+	for _, tk := range timeKeepers.transactions {
+		if b := get(tk.ProposedTime); b != nil {
+			b.proposed++
+		}
+		if b := get(tk.EndorsedTime); b != nil {
+			b.endorsed++
+			b.endorsementLatency += tk.EndorsedTime - tk.ProposedTime
+		}
+		if b := get(tk.BroadcastTime); b != nil {
+			b.broadcast++
+			b.integrationLatency += tk.BroadcastTime - tk.EndorsedTime
+		}
+		if b := get(tk.OrderedTime); b != nil {
+			b.ordered++
+			b.ackLatency += tk.OrderedTime - tk.BroadcastTime
+		}
+		if b := get(tk.ObservedTime); b != nil {
+			b.observed++
+			b.e2eLatency += tk.ObservedTime - tk.ProposedTime
+			if tk.OrderedTime != 0 {
+				b.committed++
+				b.commitLatency += tk.ObservedTime - tk.OrderedTime
+			}
+		}
+	}
+
+	return buckets
+}
+
+// averageMs returns the average of sum over n transactions in millisecond
+func averageMs(sum int64, n int) float64 {
+	if n == 0 {
+		return 0.0
+	}
+	return float64(sum) / float64(n) / float64(1e6)
+}
+
+// mustWriteTimeSeries writes the per-second throughput and latency of each pipeline stage to a CSV file
+func mustWriteTimeSeries(startTime time.Time, endTime time.Time) {
+	tsFile, err := os.Create(config.TimeSeriesPath)
+	if err != nil {
+		logger.Fatalf("Failed to create time series file %s: %v\n", config.TimeSeriesPath, err)
+	}
+	defer tsFile.Close()
+
+	tsFile.WriteString("second,proposed,endorsed,broadcast,ordered,observed,endorse(ms),integrate(ms),ack(ms),ack-to-commit(ms),e2e(ms)\n")
+	for i, b := range collectBuckets(startTime, endTime) {
+		tsFile.WriteString(fmt.Sprintf("%d,%d,%d,%d,%d,%d,%.2f,%.2f,%.2f,%.2f,%.2f\n",
+			i,
+			b.proposed,
+			b.endorsed,
+			b.broadcast,
+			b.ordered,
+			b.observed,
+			averageMs(b.endorsementLatency, b.endorsed),
+			averageMs(b.integrationLatency, b.broadcast),
+			averageMs(b.ackLatency, b.ordered),
+			averageMs(b.commitLatency, b.committed),
+			averageMs(b.e2eLatency, b.observed),
+		))
+	}
+}
+
+// steadyStateTPS returns the throughput of observed transactions excluding
+// the warm-up window at the beginning and the cool-down window at the end
+func steadyStateTPS(startTime time.Time, endTime time.Time) (float64, error) {
+	windowStart := startTime.Add(time.Duration(config.WarmUp) * time.Second).UnixNano()
+	windowEnd := endTime.Add(-time.Duration(config.CoolDown) * time.Second).UnixNano()
+	if windowEnd <= windowStart {
+		return 0.0, errors.Errorf("warm-up %ds and cool-down %ds cover the whole run", config.WarmUp, config.CoolDown)
+	}
+
+	observed := 0
+	for _, tk := range timeKeepers.transactions {
+		if tk.ObservedTime >= windowStart && tk.ObservedTime < windowEnd {
+			observed++
+		}
+	}
+
+	return float64(observed) * 1e9 / float64(windowEnd-windowStart), nil
+}
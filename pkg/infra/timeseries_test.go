@@ -0,0 +1,92 @@
+package infra
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSteadyStateTPS(t *testing.T) {
+	defer func(c *Config, tks TimeKeepers) {
+		config, timeKeepers = c, tks
+	}(config, timeKeepers)
+
+	start := time.Unix(1000, 0)
+	end := start.Add(10 * time.Second)
+	// One transaction is observed at the middle of every second
+	timeKeepers = TimeKeepers{}
+	for i := 0; i < 10; i++ {
+		observed := start.Add(time.Duration(i)*time.Second + 500*time.Millisecond).UnixNano()
+		timeKeepers.transactions = append(timeKeepers.transactions, &TimeKeeper{ObservedTime: observed})
+	}
+	// Two more in the second second, while neither a dropped transaction nor one observed after the end is counted
+	timeKeepers.transactions = append(timeKeepers.transactions,
+		&TimeKeeper{ObservedTime: start.Add(1200 * time.Millisecond).UnixNano()},
+		&TimeKeeper{ObservedTime: start.Add(1700 * time.Millisecond).UnixNano()},
+		&TimeKeeper{},
+		&TimeKeeper{ObservedTime: end.Add(time.Second).UnixNano()},
+	)
+
+	tests := []struct {
+		name     string
+		warmUp   int
+		coolDown int
+		want     float64
+		wantErr  bool
+	}{
+		{"whole run", 0, 0, 1.2, false},
+		{"warm-up", 2, 0, 1, false},
+		{"cool-down", 0, 8, 2, false},
+		{"warm-up and cool-down", 1, 8, 3, false},
+		{"window covering the whole run", 5, 5, 0, true},
+		{"window beyond the run", 8, 8, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{WarmUp: tt.warmUp, CoolDown: tt.coolDown}
+			got, err := steadyStateTPS(start, end)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("steadyStateTPS() = %f, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("steadyStateTPS() = %v, want no error", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("steadyStateTPS() = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectBuckets(t *testing.T) {
+	defer func(tks TimeKeepers) { timeKeepers = tks }(timeKeepers)
+
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) int64 { return start.Add(d).UnixNano() }
+	timeKeepers = TimeKeepers{transactions: []*TimeKeeper{
+		// proposed in second 0, endorsed and broadcast in second 1, observed in second 2
+		{ProposedTime: at(100 * time.Millisecond), EndorsedTime: at(1100 * time.Millisecond), BroadcastTime: at(1300 * time.Millisecond), ObservedTime: at(2300 * time.Millisecond)},
+		// endorsement failed, so only proposed is counted
+		{ProposedTime: at(900 * time.Millisecond)},
+		// observed after the end of the run
+		{ProposedTime: at(2 * time.Second), EndorsedTime: at(2 * time.Second), BroadcastTime: at(2 * time.Second), ObservedTime: at(5 * time.Second)},
+	}}
+
+	buckets := collectBuckets(start, start.Add(2500*time.Millisecond))
+	if len(buckets) != 3 {
+		t.Fatalf("len(collectBuckets()) = %d, want 3", len(buckets))
+	}
+	if b := buckets[0]; b.proposed != 2 || b.endorsed != 0 {
+		t.Errorf("bucket 0 = %+v, want 2 proposed and none endorsed", *b)
+	}
+	if b := buckets[1]; b.endorsed != 1 || b.broadcast != 1 || averageMs(b.endorsementLatency, b.endorsed) != 1000 {
+		t.Errorf("bucket 1 = %+v, want 1 endorsed in 1000ms and 1 broadcast", *b)
+	}
+	if b := buckets[2]; b.observed != 1 || averageMs(b.e2eLatency, b.observed) != 2200 {
+		t.Errorf("bucket 2 = %+v, want 1 observed in 2200ms end to end", *b)
+	}
+}
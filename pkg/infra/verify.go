@@ -0,0 +1,296 @@
+package infra
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/GwanWingYan/HLF-2.2/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/GwanWingYan/HLF-2.2/protoutil"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxMismatchSamples is the maximum number of mismatches listed in the report
+	maxMismatchSamples = 20
+)
+
+var (
+	mismatches   *Mismatches
+	rwsetDumper  *RWSetDumper
+	patternCache sync.Map // compiled payload patterns indexed by the pattern
+)
+
+// Expectation is what a target expects from the endorsement responses
+type Expectation struct {
+	Status         int32  `yaml:"status"`         // expected response status, any status in [200, 400) if 0
+	Payload        string `yaml:"payload"`        // expected response payload, not checked if empty
+	PayloadPattern string `yaml:"payloadPattern"` // regular expression the response payload must match, not checked if empty
+	Reads          *int   `yaml:"reads"`          // expected number of keys read from the chaincode namespace, not checked if absent
+	Writes         *int   `yaml:"writes"`         // expected number of keys written to the chaincode namespace, not checked if absent
+}
+
+func (ex *Expectation) valid() error {
+	if ex.PayloadPattern != "" {
+		if _, err := regexp.Compile(ex.PayloadPattern); err != nil {
+			return errors.Wrapf(err, "invalid payload pattern %s", ex.PayloadPattern)
+		}
+	}
+
+	if ex.Reads != nil && *ex.Reads < 0 || ex.Writes != nil && *ex.Writes < 0 {
+		return errors.New("expected numbers of keys read and written must not be negative")
+	}
+
+	return nil
+}
+
+// checksRWSet returns true if the read/write set is needed to check the expectation
+func (ex *Expectation) checksRWSet() bool {
+	return ex.Reads != nil || ex.Writes != nil
+}
+
+// match returns an empty string if the response meets the expectation, otherwise the reason.
+// 'txRWSet' may be nil if the read/write set is not checked.
+func (ex *Expectation) match(resp *peer.ProposalResponse, namespace string, txRWSet *rwsetutil.TxRwSet) string {
+	status := resp.Response.Status
+	if ex.Status == 0 && (status < 200 || status >= 400) || ex.Status != 0 && status != ex.Status {
+		return fmt.Sprintf("status %d: %s", status, resp.Response.Message)
+	}
+
+	if ex.Payload != "" && string(resp.Response.Payload) != ex.Payload {
+		return fmt.Sprintf("payload %q is not %q", resp.Response.Payload, ex.Payload)
+	}
+
+	if ex.PayloadPattern != "" {
+		pattern, ok := patternCache.Load(ex.PayloadPattern)
+		if !ok {
+			pattern, _ = patternCache.LoadOrStore(ex.PayloadPattern, regexp.MustCompile(ex.PayloadPattern))
+		}
+		if !pattern.(*regexp.Regexp).Match(resp.Response.Payload) {
+			return fmt.Sprintf("payload %q does not match %s", resp.Response.Payload, ex.PayloadPattern)
+		}
+	}
+
+	if txRWSet != nil {
+		reads, writes := 0, 0
+		for _, nsRWSet := range txRWSet.NsRwSets {
+			if nsRWSet.NameSpace == namespace {
+				reads += len(nsRWSet.KvRwSet.Reads)
+				writes += len(nsRWSet.KvRwSet.Writes)
+			}
+		}
+		if ex.Reads != nil && reads != *ex.Reads {
+			return fmt.Sprintf("%d keys are read, not %d", reads, *ex.Reads)
+		}
+		if ex.Writes != nil && writes != *ex.Writes {
+			return fmt.Sprintf("%d keys are written, not %d", writes, *ex.Writes)
+		}
+	}
+
+	return ""
+}
+
+// getResponseTxRWSet extracts the read/write set simulated by the endorser from the response
+func getResponseTxRWSet(resp *peer.ProposalResponse) (*rwsetutil.TxRwSet, error) {
+	proposalResponsePayload, err := protoutil.UnmarshalProposalResponsePayload(resp.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	ccAction, err := protoutil.UnmarshalChaincodeAction(proposalResponsePayload.Extension)
+	if err != nil {
+		return nil, err
+	}
+
+	txRWSet := &rwsetutil.TxRwSet{}
+	if err = txRWSet.FromProtoBytes(ccAction.Results); err != nil {
+		return nil, err
+	}
+	return txRWSet, nil
+}
+
+// verifyResponses checks every response of the transaction against the expectation of its target,
+// records the first mismatch if any, and dumps the read/write set of every response if 'checkRWSet' is true.
+// It returns true if all responses meet the expectation, or if the transaction is unknown,
+// which has no target to check against and is left to the caller.
+func verifyResponses(element *Element) bool {
+	id, ok := txid2id[element.Txid]
+	if !ok {
+		return true
+	}
+	target := config.Targets[txTargets[id]]
+
+	// Responses after a mismatch are still checked, so that all of them are dumped
+	mismatchIndex, mismatchReason := 0, ""
+	for i, resp := range element.Responses {
+		var txRWSet *rwsetutil.TxRwSet
+		reason := ""
+		if target.Expect.checksRWSet() || config.CheckRWSet {
+			var err error
+			txRWSet, err = getResponseTxRWSet(resp)
+			if err != nil {
+				reason = fmt.Sprintf("fail to extract read/write set: %v", err)
+			}
+		}
+
+		if reason == "" {
+			if config.CheckRWSet {
+				rwsetDumper.dump(element.Txid, i, txRWSet)
+			}
+			reason = target.Expect.match(resp, target.Chaincode, txRWSet)
+		}
+
+		if reason != "" && mismatchReason == "" {
+			mismatchIndex, mismatchReason = i, reason
+		}
+	}
+
+	if mismatchReason != "" {
+		mismatches.add(id, element.Txid, mismatchIndex, mismatchReason)
+		return false
+	}
+	return true
+}
+
+// mismatch is a response which does not meet the expectation
+type mismatch struct {
+	id            int
+	txid          string
+	responseIndex int
+	reason        string
+}
+
+// Mismatches counts the transactions whose responses do not meet the expectation,
+// and keeps the first few of them as samples
+type Mismatches struct {
+	samples []*mismatch
+	lock    sync.Mutex
+}
+
+func initMismatches() {
+	mismatches = &Mismatches{}
+}
+
+func (ms *Mismatches) add(id int, txid string, responseIndex int, reason string) {
+	Metric.AddMismatched()
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if len(ms.samples) < maxMismatchSamples {
+		ms.samples = append(ms.samples, &mismatch{
+			id:            id,
+			txid:          txid,
+			responseIndex: responseIndex,
+			reason:        reason,
+		})
+	}
+}
+
+// report writes the number of mismatches and the samples to the report
+func (ms *Mismatches) report() {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	reportCh <- fmt.Sprintf("Number of MISMATCHED Transactions: %d", atomic.LoadInt32(&Metric.Mismatched))
+	for _, m := range ms.samples {
+		reportCh <- fmt.Sprintf("    Mismatch: %d %s response %d: %s", m.id, m.txid, m.responseIndex, m.reason)
+	}
+}
+
+// rwsetRecord is one line of the read/write set file
+type rwsetRecord struct {
+	Txid      string       `json:"txid"`
+	Response  int          `json:"response"` // index of the response in the transaction
+	Namespace string       `json:"namespace"`
+	Reads     []rwsetRead  `json:"reads"`
+	Writes    []rwsetWrite `json:"writes"`
+	Ranges    int          `json:"rangeQueries,omitempty"`
+}
+
+type rwsetRead struct {
+	Key      string `json:"key"`
+	BlockNum uint64 `json:"blockNum"`
+	TxNum    uint64 `json:"txNum"`
+}
+
+type rwsetWrite struct {
+	Key      string `json:"key"`
+	IsDelete bool   `json:"isDelete,omitempty"`
+	Value    string `json:"value"`
+}
+
+// RWSetDumper writes read/write sets to a file, one JSON object for each namespace of each transaction
+type RWSetDumper struct {
+	file   *os.File
+	writer *bufio.Writer
+	lock   sync.Mutex
+}
+
+func initRWSetDumper() {
+	rwsetDumper = nil
+	if !config.CheckRWSet {
+		return
+	}
+
+	file, err := os.Create(config.RWSetPath)
+	if err != nil {
+		logger.Fatalf("Fail to create read/write set file %s: %v", config.RWSetPath, err)
+	}
+	rwsetDumper = &RWSetDumper{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+}
+
+func (d *RWSetDumper) dump(txid string, responseIndex int, txRWSet *rwsetutil.TxRwSet) {
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		record := &rwsetRecord{
+			Txid:      txid,
+			Response:  responseIndex,
+			Namespace: nsRWSet.NameSpace,
+			Reads:     []rwsetRead{},
+			Writes:    []rwsetWrite{},
+			Ranges:    len(nsRWSet.KvRwSet.RangeQueriesInfo),
+		}
+		for _, r := range nsRWSet.KvRwSet.Reads {
+			read := rwsetRead{Key: r.Key}
+			if r.Version != nil {
+				read.BlockNum = r.Version.BlockNum
+				read.TxNum = r.Version.TxNum
+			}
+			record.Reads = append(record.Reads, read)
+		}
+		for _, w := range nsRWSet.KvRwSet.Writes {
+			record.Writes = append(record.Writes, rwsetWrite{Key: w.Key, IsDelete: w.IsDelete, Value: string(w.Value)})
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			logger.Errorf("Fail to marshal read/write set of %s: %v", txid, err)
+			continue
+		}
+
+		d.lock.Lock()
+		d.writer.Write(line)
+		d.writer.WriteByte('\n')
+		d.lock.Unlock()
+	}
+}
+
+// close flushes the read/write sets to the file.
+// It is called after the pipeline stops, since integrators and evaluators dump until then.
+func (d *RWSetDumper) close() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.writer.Flush()
+	d.file.Close()
+}
@@ -0,0 +1,155 @@
+package infra
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GwanWingYan/HLF-2.2/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/GwanWingYan/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/GwanWingYan/fabric-protos-go/peer"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestExpectationMatch(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	response := func(status int32, payload string) *peer.ProposalResponse {
+		return &peer.ProposalResponse{Response: &peer.Response{Status: status, Message: "message", Payload: []byte(payload)}}
+	}
+	// Two keys read and one written by the chaincode, and one read by another namespace
+	txRWSet := &rwsetutil.TxRwSet{NsRwSets: []*rwsetutil.NsRwSet{
+		{
+			NameSpace: "basic",
+			KvRwSet: &kvrwset.KVRWSet{
+				Reads:  []*kvrwset.KVRead{{Key: "a"}, {Key: "b"}},
+				Writes: []*kvrwset.KVWrite{{Key: "a", Value: []byte("1")}},
+			},
+		},
+		{
+			NameSpace: "_lifecycle",
+			KvRwSet:   &kvrwset.KVRWSet{Reads: []*kvrwset.KVRead{{Key: "namespaces/fields/basic/Sequence"}}},
+		},
+	}}
+
+	tests := []struct {
+		name     string
+		expect   Expectation
+		resp     *peer.ProposalResponse
+		rwset    *rwsetutil.TxRwSet
+		mismatch string // a part of the reason, empty if matched
+	}{
+		{"any success", Expectation{}, response(200, ""), nil, ""},
+		{"any redirection", Expectation{}, response(302, ""), nil, ""},
+		{"any failure", Expectation{}, response(500, ""), nil, "status 500: message"},
+		{"expected failure", Expectation{Status: 500}, response(500, ""), nil, ""},
+		{"unexpected success", Expectation{Status: 404}, response(200, ""), nil, "status 200"},
+		{"payload", Expectation{Payload: "100"}, response(200, "100"), nil, ""},
+		{"wrong payload", Expectation{Payload: "100"}, response(200, "99"), nil, `payload "99" is not "100"`},
+		{"payload pattern", Expectation{PayloadPattern: `^\d+$`}, response(200, "100"), nil, ""},
+		{"payload against pattern", Expectation{PayloadPattern: `^\d+$`}, response(200, "1a"), nil, `does not match ^\d+$`},
+		{"reads and writes", Expectation{Reads: intPtr(2), Writes: intPtr(1)}, response(200, ""), txRWSet, ""},
+		{"other namespaces are not counted", Expectation{Reads: intPtr(3)}, response(200, ""), txRWSet, "2 keys are read, not 3"},
+		{"wrong writes", Expectation{Writes: intPtr(0)}, response(200, ""), txRWSet, "1 keys are written, not 0"},
+		{"no read/write set", Expectation{Reads: intPtr(0)}, response(200, ""), nil, ""},
+		{"status goes first", Expectation{Payload: "100", Reads: intPtr(3)}, response(500, "99"), txRWSet, "status 500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.expect.match(tt.resp, "basic", tt.rwset)
+			if tt.mismatch == "" && reason != "" {
+				t.Errorf("match() = %q, want a match", reason)
+			}
+			if tt.mismatch != "" && !strings.Contains(reason, tt.mismatch) {
+				t.Errorf("match() = %q, want a mismatch of %q", reason, tt.mismatch)
+			}
+		})
+	}
+}
+
+// endorsedResponse builds a successful response carrying the read/write set simulated by the endorser
+func endorsedResponse(t *testing.T, txRWSet *rwsetutil.TxRwSet) *peer.ProposalResponse {
+	results, err := txRWSet.ToProtoBytes()
+	if err != nil {
+		t.Fatalf("Fail to marshal read/write set: %v", err)
+	}
+	extension, err := proto.Marshal(&peer.ChaincodeAction{Results: results})
+	if err != nil {
+		t.Fatalf("Fail to marshal chaincode action: %v", err)
+	}
+	payload, err := proto.Marshal(&peer.ProposalResponsePayload{Extension: extension})
+	if err != nil {
+		t.Fatalf("Fail to marshal proposal response payload: %v", err)
+	}
+	return &peer.ProposalResponse{Payload: payload, Response: &peer.Response{Status: 200}}
+}
+
+func TestVerifyResponses(t *testing.T) {
+	defer func(c *Config, m map[string]int, tt []int, mi *MetricInstance, ms *Mismatches, d *RWSetDumper) {
+		config, txid2id, txTargets, Metric, mismatches, rwsetDumper = c, m, tt, mi, ms, d
+	}(config, txid2id, txTargets, Metric, mismatches, rwsetDumper)
+
+	writes := 1
+	config = &Config{
+		Targets:    []Target{{Chaincode: "basic", Expect: Expectation{Writes: &writes}}},
+		CheckRWSet: true,
+		RWSetPath:  filepath.Join(t.TempDir(), "rwsets"),
+	}
+	txid2id = map[string]int{"tx0": 0, "tx1": 1}
+	txTargets = []int{0, 0}
+	Metric = NewMetricInstance()
+	initMismatches()
+	initRWSetDumper()
+
+	write := func(keys ...string) *rwsetutil.TxRwSet {
+		kvWrites := make([]*kvrwset.KVWrite, len(keys))
+		for i, key := range keys {
+			kvWrites[i] = &kvrwset.KVWrite{Key: key, Value: []byte("1")}
+		}
+		return &rwsetutil.TxRwSet{NsRwSets: []*rwsetutil.NsRwSet{
+			{NameSpace: "basic", KvRwSet: &kvrwset.KVRWSet{Writes: kvWrites}},
+		}}
+	}
+
+	matched := &Element{Txid: "tx0", Responses: []*peer.ProposalResponse{
+		endorsedResponse(t, write("a")),
+		endorsedResponse(t, write("a")),
+	}}
+	if !verifyResponses(matched) {
+		t.Errorf("verifyResponses(tx0) = false, want true")
+	}
+
+	// Both endorsers write more keys, and the responses after the first mismatch are still dumped
+	mismatched := &Element{Txid: "tx1", Responses: []*peer.ProposalResponse{
+		endorsedResponse(t, write("a", "b")),
+		endorsedResponse(t, write("a", "b", "c")),
+	}}
+	if verifyResponses(mismatched) {
+		t.Errorf("verifyResponses(tx1) = true, want false")
+	}
+
+	if Metric.Mismatched != 1 || len(mismatches.samples) != 1 {
+		t.Fatalf("%d mismatches with %d samples, want 1", Metric.Mismatched, len(mismatches.samples))
+	}
+	if m := mismatches.samples[0]; m.txid != "tx1" || m.responseIndex != 0 || !strings.Contains(m.reason, "2 keys are written") {
+		t.Errorf("mismatch = %+v, want the first response of tx1 writing 2 keys", *m)
+	}
+
+	rwsetDumper.close()
+	dumped, err := ioutil.ReadFile(config.RWSetPath)
+	if err != nil {
+		t.Fatalf("Fail to read the read/write set file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(dumped)), "\n")
+	// Every response is dumped, not only the first one of each transaction
+	want := []string{`"txid":"tx0","response":0`, `"txid":"tx0","response":1`, `"txid":"tx1","response":0`, `"txid":"tx1","response":1`}
+	if len(lines) != len(want) {
+		t.Fatalf("%d read/write sets are dumped, want %d:\n%s", len(lines), len(want), dumped)
+	}
+	for i, w := range want {
+		if !strings.Contains(lines[i], w) {
+			t.Errorf("read/write set %d = %s, want %s", i, lines[i], w)
+		}
+	}
+}
@@ -12,6 +12,9 @@ import (
 const (
 	accountFilePath     = "ACCOUNTS.txt"
 	transactionFilePath = "TRANSACTIONS.txt"
+
+	// randomTransientValue in the transient map is replaced with a random string for each transaction
+	randomTransientValue = "$random"
 )
 
 var (
@@ -44,28 +47,60 @@ type WorkloadGenerator struct {
 	accounts   []string
 }
 
-func generateCCArgsList() [][]string {
-	initSeed()
+// generateCCArgsList generates the arguments of every transaction by the type of its target
+func generateCCArgsList(targetList []int) [][]string {
 	wg := NewWorkloadGenerator()
 
 	for i := 0; i < config.TxNum; i++ {
-		wg.ccArgsList[i] = wg.generateCCArgs()
+		wg.ccArgsList[i] = wg.generateCCArgs(config.Targets[targetList[i]].TxType)
 	}
 
 	wg.mustWriteArgsToFile()
-	if config.TxType == "put" {
-		wg.mustWriteAccountsToFile()
+	if hasTxType("put") {
+		wg.mustWriteAccountsToFile(targetList)
 	}
 
 	return wg.ccArgsList
 }
 
+// hasTxType returns true if any target uses the transaction type
+func hasTxType(txType string) bool {
+	for _, t := range config.Targets {
+		if t.TxType == txType {
+			return true
+		}
+	}
+	return false
+}
+
+// generateTransientList generates the transient map of every transaction from its target,
+// each of which is nil if the target has no transient data
+func generateTransientList(targetList []int) []map[string][]byte {
+	transientList := make([]map[string][]byte, config.TxNum)
+	for i := range transientList {
+		data := config.Targets[targetList[i]].Transient
+		if len(data) == 0 {
+			continue
+		}
+
+		transient := make(map[string][]byte, len(data))
+		for key, value := range data {
+			if value == randomTransientValue {
+				value = getName(64)
+			}
+			transient[key] = []byte(value)
+		}
+		transientList[i] = transient
+	}
+	return transientList
+}
+
 func NewWorkloadGenerator() *WorkloadGenerator {
 	wg := &WorkloadGenerator{
 		ccArgsList: make([][]string, config.TxNum),
 	}
 
-	if config.TxType == "conflict" {
+	if hasTxType("conflict") {
 		wg.mustLoadAccountsFromFile()
 	}
 
@@ -92,8 +127,8 @@ func (wg *WorkloadGenerator) mustLoadAccountsFromFile() {
 	logger.Infof("Load %d accounts from %s\n", len(wg.accounts), accountFilePath)
 }
 
-func (wg *WorkloadGenerator) generateCCArgs() []string {
-	switch config.TxType {
+func (wg *WorkloadGenerator) generateCCArgs(txType string) []string {
+	switch txType {
 	case "put":
 		return wg.generateCCArgsPut()
 	case "conflict":
@@ -149,13 +184,16 @@ func (wg *WorkloadGenerator) mustWriteArgsToFile() {
 	}
 }
 
-func (wg *WorkloadGenerator) mustWriteAccountsToFile() {
+func (wg *WorkloadGenerator) mustWriteAccountsToFile(targetList []int) {
 	af, err := os.Create(accountFilePath)
 	defer af.Close()
 	if err != nil {
 		logger.Fatalf("Failed to create file %s: %v\n", accountFilePath, err)
 	}
 	for i := 0; i < config.TxNum; i++ {
+		if config.Targets[targetList[i]].TxType != "put" {
+			continue
+		}
 		// only record the account id
 		af.WriteString(wg.ccArgsList[i][1] + "\n")
 	}